@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+)
+
+// Adaptive rate options
+var (
+	// p99 latency that the adaptive rate holds, 0 to disable it
+	targetP99Ms float64
+	// Increase of the rate after each interval within the target
+	targetStep float64
+)
+
+// Factor applied to the rate after each interval above the target
+const adaptiveDecrease = 0.75
+
+// Number of intervals over which the sustained throughput is reported
+const adaptiveWindow = 10
+
+// adaptivePeriod is the throughput sustained within the target during a window of intervals
+type adaptivePeriod struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Mean reply rate of the intervals within the target, 0 if none was
+	Throughput float64 `json:"throughput"`
+	// Share of the intervals within the target
+	WithinTarget float64 `json:"within_target"`
+}
+
+// adaptiveSummary sums up the throughput sustained by the adaptive rate during the run
+type adaptiveSummary struct {
+	Target  time.Duration    `json:"target"`
+	Periods []adaptivePeriod `json:"periods"`
+}
+
+// adaptiveController adjusts the rate of the queries after each interval to hold the p99
+// latency at the target, with additive increases and multiplicative decreases (AIMD)
+type adaptiveController struct {
+	target time.Duration
+	step   float64
+
+	// Window of intervals in progress
+	start      time.Time
+	intervals  int
+	within     int
+	throughput float64
+
+	periods []adaptivePeriod
+}
+
+// adaptive is the adaptive rate controller, when there is one
+var adaptive *adaptiveController
+
+func newAdaptiveController(target time.Duration, step float64) *adaptiveController {
+	return &adaptiveController{target: target, step: step}
+}
+
+// update adjusts the rate after an interval, and returns the new rate along with the
+// throughput sustained during the window of intervals when it is over
+func (c *adaptiveController) update(start, end time.Time, sent, replies int, p99 time.Duration) (float64, *adaptivePeriod) {
+	current, paused := pacing.state()
+	if paused || sent == 0 {
+		return current, nil
+	}
+
+	// Start from the rate actually reached when the workers cannot keep up with the current
+	// one, so that the rate does not run away from the throughput
+	length := end.Sub(start).Seconds()
+	rate := float64(sent) / length
+	if current > 0 && current < rate {
+		rate = current
+	}
+	if p99 <= c.target {
+		rate += c.step
+	} else {
+		rate *= adaptiveDecrease
+	}
+	if rate < c.step {
+		rate = c.step
+	}
+	pacing.adjust(rate)
+
+	if c.intervals == 0 {
+		c.start = start
+	}
+	c.intervals++
+	if p99 <= c.target {
+		c.within++
+		c.throughput += float64(replies) / length
+	}
+	if c.intervals < adaptiveWindow {
+		return rate, nil
+	}
+	period := c.close(end)
+	return rate, &period
+}
+
+// close ends the window of intervals in progress, and returns its throughput
+func (c *adaptiveController) close(end time.Time) adaptivePeriod {
+	period := adaptivePeriod{Start: c.start, End: end, WithinTarget: float64(c.within) / float64(c.intervals)}
+	if c.within > 0 {
+		period.Throughput = c.throughput / float64(c.within)
+	}
+	c.periods = append(c.periods, period)
+	c.intervals, c.within, c.throughput = 0, 0, 0
+	return period
+}
+
+// summary returns the throughput sustained during each window of intervals, including the
+// last one, unfinished
+func (c *adaptiveController) summary(end time.Time) *adaptiveSummary {
+	if c.intervals > 0 {
+		c.close(end)
+	}
+	return &adaptiveSummary{Target: c.target, Periods: c.periods}
+}
+
+// printAdaptivePeriod prints the throughput sustained during a window of intervals
+func printAdaptivePeriod(target time.Duration, period *adaptivePeriod) {
+	fmt.Printf(
+		"%s %.0fr/s at p99 <= %s (%.0f%% of the last %s within the target)\n",
+		aurora.Bold("Sustained:"),
+		period.Throughput,
+		target,
+		100*period.WithinTarget,
+		period.End.Sub(period.Start).Round(time.Millisecond),
+	)
+}
+
+// printAdaptiveSummary prints the throughput sustained by the adaptive rate
+func printAdaptiveSummary(s *adaptiveSummary) {
+	if len(s.Periods) == 0 {
+		return
+	}
+	last := s.Periods[len(s.Periods)-1]
+	low, high := last.Throughput, last.Throughput
+	for _, period := range s.Periods {
+		if period.Throughput < low {
+			low = period.Throughput
+		}
+		if period.Throughput > high {
+			high = period.Throughput
+		}
+	}
+	fmt.Printf(
+		"  Adaptive rate: %.0fr/s sustained at p99 <= %s at the end of the run (min=%.0fr/s / max=%.0fr/s over %d periods)\n",
+		last.Throughput,
+		s.Target,
+		low,
+		high,
+		len(s.Periods),
+	)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveController(t *testing.T) {
+	defer pacing.setRate(0)
+	pacing.setRate(1000)
+	pacing.take()
+	c := newAdaptiveController(20*time.Millisecond, 100)
+	start := time.Unix(1000, 0)
+	next := func(sent int, p99 time.Duration) (float64, *adaptivePeriod) {
+		defer func() { start = start.Add(time.Second) }()
+		return c.update(start, start.Add(time.Second), sent, sent, p99)
+	}
+
+	// Additive increase within the target, multiplicative decrease above
+	if rate, _ := next(1000, 10*time.Millisecond); rate != 1100 {
+		t.Errorf("Invalid rate within the target: %f, expected 1100", rate)
+	}
+	if rate, _ := next(1100, 50*time.Millisecond); rate != 1100*adaptiveDecrease {
+		t.Errorf("Invalid rate above the target: %f, expected %f", rate, 1100*adaptiveDecrease)
+	}
+	// The workers only reached 500q/s: grow from there
+	if rate, _ := next(500, 10*time.Millisecond); rate != 600 {
+		t.Errorf("Invalid rate when the workers cannot keep up: %f, expected 600", rate)
+	}
+	if current, _ := pacing.state(); current != 600 || pacing.take() {
+		t.Errorf("The adaptive rate should be applied without counting as a change: %f", current)
+	}
+
+	var period *adaptivePeriod
+	for i := 3; i < adaptiveWindow; i++ {
+		_, period = next(600, 10*time.Millisecond)
+	}
+	if period == nil {
+		t.Fatal("The sustained throughput should be reported after a window of intervals")
+	}
+	// 1000, 500 and 7*600 replies/s within the target, out of 10 intervals
+	if expected := (1000. + 500 + 7*600) / 9; math.Abs(period.Throughput-expected) > 1e-9 || period.WithinTarget != 0.9 {
+		t.Errorf("Invalid period: %+v, expected %f", period, expected)
+	}
+
+	next(600, 10*time.Millisecond)
+	summary := c.summary(start)
+	if len(summary.Periods) != 2 || summary.Periods[1].Throughput != 600 {
+		t.Errorf("Invalid summary: %+v", summary)
+	}
+}
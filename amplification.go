@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/miekg/dns"
+)
+
+// Maximum number of lines of the amplification report
+const amplificationLines = 20
+
+// amplificationKey groups the queries by type and name pattern
+type amplificationKey struct {
+	qtype   uint16
+	pattern string
+}
+
+// amplificationStats are the queries sent by the workers to the resolver, and received by
+// the authoritative server from the resolver, for a query type and name pattern
+type amplificationStats struct {
+	Qtype    string `json:"qtype"`
+	Pattern  string `json:"pattern"`
+	Client   int    `json:"client"`
+	Upstream int    `json:"upstream"`
+}
+
+// ratio returns the number of upstream queries per client query
+func (s amplificationStats) ratio() float64 {
+	if s.Client == 0 {
+		return 0
+	}
+	return float64(s.Upstream) / float64(s.Client)
+}
+
+// amplificationCounter counts the client and upstream queries of the whole run
+type amplificationCounter struct {
+	// Apex of the test zone, counted apart from the names below it
+	origin   string
+	mu       sync.Mutex
+	client   map[amplificationKey]int
+	upstream map[amplificationKey]int
+}
+
+// key returns the key under which a query is counted
+func (a *amplificationCounter) key(qtype uint16, name string) amplificationKey {
+	return amplificationKey{qtype: qtype, pattern: namePattern(name, a.origin)}
+}
+
+// record adds a query sent by a worker, or received by the authoritative server
+func (a *amplificationCounter) record(upstream bool, qtype uint16, name string) {
+	key := a.key(qtype, name)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		a.client = make(map[amplificationKey]int)
+		a.upstream = make(map[amplificationKey]int)
+	}
+	if upstream {
+		a.upstream[key]++
+	} else {
+		a.client[key]++
+	}
+}
+
+// add adds the queries sent by the workers during an interval, counted in their own stats so
+// that they do not contend for the counter on each query
+func (a *amplificationCounter) add(client map[amplificationKey]int) {
+	if len(client) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		a.client = make(map[amplificationKey]int)
+		a.upstream = make(map[amplificationKey]int)
+	}
+	for key, n := range client {
+		a.client[key] += n
+	}
+}
+
+// stats returns the queries counted for each type and pattern, by decreasing number of
+// upstream queries
+func (a *amplificationCounter) stats() []amplificationStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys := make(map[amplificationKey]bool)
+	for key := range a.client {
+		keys[key] = true
+	}
+	for key := range a.upstream {
+		keys[key] = true
+	}
+	var stats []amplificationStats
+	for key := range keys {
+		stats = append(stats, amplificationStats{
+			Qtype:    typeName(key.qtype),
+			Pattern:  key.pattern,
+			Client:   a.client[key],
+			Upstream: a.upstream[key],
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Upstream != stats[j].Upstream {
+			return stats[i].Upstream > stats[j].Upstream
+		}
+		if stats[i].Client != stats[j].Client {
+			return stats[i].Client > stats[j].Client
+		}
+		return stats[i].Pattern+stats[i].Qtype < stats[j].Pattern+stats[j].Qtype
+	})
+	return stats
+}
+
+// namePattern generalizes a name to the pattern it is counted in: its leftmost label is
+// replaced with a wildcard, so that names generated below a common parent are grouped
+// together, unless it is the apex of the test zone
+func namePattern(name, origin string) string {
+	name = dns.CanonicalName(name)
+	if name == origin {
+		return name
+	}
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 2 {
+		return name
+	}
+	return "*." + strings.Join(labels[1:], ".") + "."
+}
+
+// printAmplification prints the upstream queries received for each client query
+func printAmplification(stats []amplificationStats) {
+	if len(stats) == 0 {
+		return
+	}
+	fmt.Println("  Amplification:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "    QTYPE\tPATTERN\tCLIENT\tUPSTREAM\tRATIO")
+	for i, s := range stats {
+		if i == amplificationLines {
+			fmt.Fprintf(w, "    ...\t%d more\t\t\t\n", len(stats)-i)
+			break
+		}
+		ratio := "-"
+		if s.Client > 0 {
+			ratio = fmt.Sprintf("%.3f", s.ratio())
+		}
+		fmt.Fprintf(w, "    %s\t%s\t%d\t%d\t%s\n", s.Qtype, s.Pattern, s.Client, s.Upstream, ratio)
+	}
+	w.Flush()
+}
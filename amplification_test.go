@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNamePattern(t *testing.T) {
+	for name, expected := range map[string]string{
+		"stress.test":         "stress.test.",
+		"Abc123.Stress.Test.": "*.stress.test.",
+		"a.b.stress.test.":    "*.b.stress.test.",
+		"www.example.com.":    "*.example.com.",
+		"com.":                "com.",
+		".":                   ".",
+	} {
+		if pattern := namePattern(name, "stress.test."); pattern != expected {
+			t.Errorf("namePattern(%q): got %q, expected %q", name, pattern, expected)
+		}
+	}
+}
+
+func TestAmplificationCounter(t *testing.T) {
+	var counter amplificationCounter
+	if counter.stats() != nil {
+		t.Error("No stats expected before any query")
+	}
+	// The queries of the workers are counted in their stats, and added at each interval
+	counter.add(map[amplificationKey]int{
+		counter.key(dns.TypeA, "x.example.com."):    6,
+		counter.key(dns.TypeAAAA, "y.example.com."): 10,
+	})
+	for i := 0; i < 4; i++ {
+		counter.record(false, dns.TypeA, "x.example.com.")
+	}
+	for i := 0; i < 4; i++ {
+		counter.record(true, dns.TypeA, "z.example.com.")
+	}
+	counter.record(true, dns.TypeDNSKEY, "example.com.")
+
+	expected := []amplificationStats{
+		{Qtype: "A", Pattern: "*.example.com.", Client: 10, Upstream: 4},
+		{Qtype: "DNSKEY", Pattern: "*.com.", Client: 0, Upstream: 1},
+		{Qtype: "AAAA", Pattern: "*.example.com.", Client: 10, Upstream: 0},
+	}
+	stats := counter.stats()
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Invalid stats: got %+v", stats)
+	}
+	if stats[0].ratio() != 0.4 || stats[1].ratio() != 0 {
+		t.Errorf("Invalid ratios: %f, %f", stats[0].ratio(), stats[1].ratio())
+	}
+}
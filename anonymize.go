@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Length of the anonymized labels, when their length is not preserved
+const anonymizedLabelLength = 16
+
+// Characters of the anonymized labels, when their structure is not preserved
+const anonymizedAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// anonymizer replaces the labels of the names below their public suffix with a keyed hash.
+// Each label is hashed along with its parents, so that a given name is always anonymized the
+// same way, and names sharing a parent still share the same anonymized parent.
+type anonymizer struct {
+	key []byte
+	// Public suffixes, kept as is. When none matches a name, only its TLD is kept.
+	suffixes map[string]bool
+	// Parents of the wildcard rules, under which every name is a public suffix
+	wildcards map[string]bool
+	// Exceptions to the wildcard rules, which are registrable domains, hence anonymized
+	exceptions map[string]bool
+	// Keep the length of the labels
+	preserveLength bool
+	// Keep the length of the labels, and the position of their digits, hyphens and underscores
+	preserveStructure bool
+}
+
+// newAnonymizer returns an anonymizer keeping the public suffixes given as rules of the Public
+// Suffix List: a suffix, a wildcard rule (*.ck) or an exception to it (!www.ck)
+func newAnonymizer(key string, suffixes []string) *anonymizer {
+	a := &anonymizer{
+		key:        []byte(key),
+		suffixes:   make(map[string]bool),
+		wildcards:  make(map[string]bool),
+		exceptions: make(map[string]bool),
+	}
+	for _, rule := range suffixes {
+		rule = strings.ToLower(strings.Trim(rule, "."))
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			a.exceptions[strings.TrimPrefix(rule, "!")] = true
+		case strings.HasPrefix(rule, "*."):
+			a.wildcards[strings.TrimPrefix(rule, "*.")] = true
+		default:
+			a.suffixes[rule] = true
+		}
+	}
+	return a
+}
+
+// readSuffixes reads a list of public suffix rules, one per line, in the format of the Public
+// Suffix List (https://publicsuffix.org/list/): comments start with //, and the rules are
+// only made of their first word.
+func readSuffixes(r io.Reader) ([]string, error) {
+	var suffixes []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rule := strings.Fields(line)[0]
+		if strings.TrimPrefix(strings.TrimPrefix(rule, "!"), "*.") == "" {
+			// A wildcard or exception without a name
+			continue
+		}
+		suffixes = append(suffixes, rule)
+	}
+	return suffixes, scanner.Err()
+}
+
+// publicSuffix returns the number of labels of the public suffix of the name, following the
+// algorithm of the Public Suffix List: an exception prevails, else the longest rule matching
+func (a *anonymizer) publicSuffix(labels []string) int {
+	for i := range labels {
+		if a.exceptions[strings.Join(labels[i:], ".")] {
+			// The public suffix is the parent of the exception
+			return len(labels) - i - 1
+		}
+	}
+	for i := range labels {
+		if a.suffixes[strings.Join(labels[i:], ".")] ||
+			i+1 < len(labels) && a.wildcards[strings.Join(labels[i+1:], ".")] {
+			return len(labels) - i
+		}
+	}
+	// Implicit rule: the TLD
+	return 1
+}
+
+// anonymize returns the anonymized name
+func (a *anonymizer) anonymize(name string) string {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	if len(labels) == 0 {
+		return name
+	}
+
+	kept := a.publicSuffix(labels)
+	anonymized := make([]string, len(labels))
+	copy(anonymized[len(labels)-kept:], labels[len(labels)-kept:])
+	for i := len(labels) - kept - 1; i >= 0; i-- {
+		anonymized[i] = a.hashLabel(labels[i], strings.Join(labels[i:], "."))
+	}
+	return strings.Join(anonymized, ".") + "."
+}
+
+// hashLabel returns the anonymized label, derived from the name it starts
+func (a *anonymizer) hashLabel(label string, name string) string {
+	length := anonymizedLabelLength
+	if a.preserveLength || a.preserveStructure {
+		length = len(label)
+	}
+	stream := a.keyStream(name, length)
+
+	hashed := make([]byte, length)
+	for i, b := range stream {
+		if !a.preserveStructure {
+			hashed[i] = anonymizedAlphabet[int(b)%len(anonymizedAlphabet)]
+			continue
+		}
+		switch c := label[i]; {
+		case c >= '0' && c <= '9':
+			hashed[i] = '0' + b%10
+		case c == '-' || c == '_':
+			hashed[i] = c
+		default:
+			hashed[i] = 'a' + b%26
+		}
+	}
+	return string(hashed)
+}
+
+// keyStream returns length bytes derived from the key and the name
+func (a *anonymizer) keyStream(name string, length int) []byte {
+	var stream []byte
+	for counter := byte(0); len(stream) < length; counter++ {
+		mac := hmac.New(sha256.New, a.key)
+		mac.Write([]byte{counter})
+		mac.Write([]byte(name))
+		stream = mac.Sum(stream)
+	}
+	return stream[:length]
+}
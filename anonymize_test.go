@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnonymize(t *testing.T) {
+	a := newAnonymizer("secret", []string{"co.uk", ".in-addr.arpa."})
+
+	// The public suffixes are kept, along with the TLD when none matches
+	for name, suffix := range map[string]string{
+		"www.example.co.uk.":          ".co.uk.",
+		"mail.example.com.":           ".com.",
+		"4.3.2.1.in-addr.arpa.":       ".in-addr.arpa.",
+		"co.uk.":                      "co.uk.",
+		"deep.sub.domain.example.fr.": ".fr.",
+	} {
+		anonymized := a.anonymize(name)
+		if !strings.HasSuffix(anonymized, suffix) || anonymized == name && name != suffix {
+			t.Errorf("anonymize(%q): got %q, expected a name ending with %q", name, anonymized, suffix)
+		}
+		if dns.CountLabel(anonymized) != dns.CountLabel(name) {
+			t.Errorf("anonymize(%q): got %q, with a different number of labels", name, anonymized)
+		}
+		if _, ok := dns.IsDomainName(anonymized); !ok {
+			t.Errorf("anonymize(%q): got invalid name %q", name, anonymized)
+		}
+	}
+
+	// Names are anonymized consistently, and keep their common parents
+	www, mail := a.anonymize("www.Example.com."), a.anonymize("mail.example.com.")
+	if www != a.anonymize("www.example.com.") {
+		t.Error("A name should always be anonymized the same way")
+	}
+	if dns.SplitDomainName(www)[1] != dns.SplitDomainName(mail)[1] {
+		t.Errorf("Names with the same parent should keep the same parent: got %q and %q", www, mail)
+	}
+	if dns.SplitDomainName(www)[0] == dns.SplitDomainName(a.anonymize("www.example.net."))[0] {
+		t.Error("The same label under different parents should be anonymized differently")
+	}
+	if newAnonymizer("other", nil).anonymize("www.example.com.") == www {
+		t.Error("Different keys should give different names")
+	}
+}
+
+func TestAnonymizePreserve(t *testing.T) {
+	a := newAnonymizer("secret", nil)
+	a.preserveLength = true
+	anonymized := a.anonymize("a.mail-server01.example.com.")
+	if len(anonymized) != len("a.mail-server01.example.com.") {
+		t.Errorf("The length of the labels should be kept: got %q", anonymized)
+	}
+
+	a.preserveStructure = true
+	labels := dns.SplitDomainName(a.anonymize("_sip.mail-server01.example.com."))
+	if len(labels[1]) != len("mail-server01") || labels[1][4] != '-' || labels[0][0] != '_' ||
+		!strings.ContainsAny(labels[1][11:], "0123456789") || strings.ContainsAny(labels[1][:4], "0123456789") {
+		t.Errorf("The structure of the labels should be kept: got %v", labels)
+	}
+}
+
+func TestReadSuffixes(t *testing.T) {
+	list := "// comment\n\ncom\nco.uk\n*.ck\n!www.ck\n!\n*.\n"
+	suffixes, err := readSuffixes(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(suffixes, " ") != "com co.uk *.ck !www.ck" {
+		t.Errorf("Invalid suffixes: got %v", suffixes)
+	}
+}
+
+func TestAnonymizeWildcards(t *testing.T) {
+	a := newAnonymizer("secret", []string{"*.ck", "!www.ck"})
+	for name, kept := range map[string]int{
+		// Every name under ck is a public suffix
+		"mail.example.ck.": 2,
+		"example.ck.":      2,
+		// Except www.ck, which is a registrable domain
+		"www.ck.":      1,
+		"mail.www.ck.": 1,
+	} {
+		labels := dns.SplitDomainName(name)
+		anonymized := dns.SplitDomainName(a.anonymize(name))
+		for i := range labels {
+			hashed := i < len(labels)-kept
+			if (anonymized[i] != labels[i]) != hashed {
+				t.Errorf("anonymize(%q): got %q, expected the last %d labels only to be kept", name, anonymized, kept)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Built-in authoritative server options. The server answers for a DNSSEC-signed test zone,
+// so that it can be configured as the upstream of the resolver under test, and counts the
+// queries the resolver sends to it.
+var (
+	authAddress  string
+	authZoneName string
+	authNames    int
+	authKeyFile  string
+	authTTL      int
+
+	// Workload querying random non-existent names under a zone
+	nxdomainZone string
+)
+
+// authoritative is the built-in authoritative server, when one is running
+var authoritative *authServer
+
+// Length of the labels of the names generated in the test zone and by the nxdomain workload
+const authLabelLength = 12
+
+// Characters of the labels generated in the test zone and by the nxdomain workload
+const authLabelAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Validity of the signatures of the test zone
+const authSignatureValidity = 30 * 24 * time.Hour
+
+// authServer answers the queries for the test zone
+type authServer struct {
+	origin string
+	// Owner names of the zone, in canonical order
+	names []string
+	// Signed RRsets of each owner name, by type
+	rrsets map[string]map[uint16]*signedRRset
+	// Public key of the zone
+	key *dns.DNSKEY
+	// Queries received from the resolver
+	queries upstreamCounter
+	// Queries sent by the workers and received from the resolver, by type and name pattern
+	amplification amplificationCounter
+	// Queries for the name of the thundering herd test
+	herd herdCounter
+	// Outage simulated during the run, if any
+	outage *outageSchedule
+}
+
+// signedRRset is an RRset of the zone, with its signature
+type signedRRset struct {
+	records []dns.RR
+	rrsig   *dns.RRSIG
+}
+
+// upstreamCounter counts the queries received by the authoritative server
+type upstreamCounter struct {
+	mu      sync.Mutex
+	queries int
+}
+
+// record adds a received query to the counter
+func (u *upstreamCounter) record() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queries++
+}
+
+// take returns the queries received since the last call
+func (u *upstreamCounter) take() (queries int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	queries = u.queries
+	u.queries = 0
+	return
+}
+
+// newAuthServer builds and signs the test zone: its apex, a name server and count names with
+// an A record, chained with NSEC records
+func newAuthServer(origin string, count int, nsAddress net.IP, key *dns.DNSKEY, signer crypto.Signer) (*authServer, error) {
+	origin = dns.CanonicalName(origin)
+	s := &authServer{origin: origin, key: key, rrsets: make(map[string]map[uint16]*signedRRset)}
+	s.amplification.origin = origin
+	header := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: uint32(authTTL)}
+	}
+
+	records := []dns.RR{
+		&dns.SOA{Hdr: header(origin, dns.TypeSOA), Ns: "ns." + origin, Mbox: "hostmaster." + origin,
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: uint32(authTTL)},
+		&dns.NS{Hdr: header(origin, dns.TypeNS), Ns: "ns." + origin},
+		key,
+	}
+	if ip4 := nsAddress.To4(); ip4 != nil {
+		records = append(records, &dns.A{Hdr: header("ns."+origin, dns.TypeA), A: ip4})
+	} else {
+		records = append(records, &dns.AAAA{Hdr: header("ns."+origin, dns.TypeAAAA), AAAA: nsAddress})
+	}
+	// The names are the same from one run to another
+	random := rand.New(rand.NewSource(1))
+	for len(records) < count+4 {
+		name := randomLabel(random) + "." + origin
+		ip := net.IPv4(198, 18, byte(len(records)>>8), byte(len(records)))
+		records = append(records, &dns.A{Hdr: header(name, dns.TypeA), A: ip})
+	}
+
+	for _, rr := range records {
+		name := rr.Header().Name
+		if s.rrsets[name] == nil {
+			s.rrsets[name] = make(map[uint16]*signedRRset)
+			s.names = append(s.names, name)
+		}
+		rrtype := rr.Header().Rrtype
+		if s.rrsets[name][rrtype] == nil {
+			s.rrsets[name][rrtype] = &signedRRset{}
+		}
+		s.rrsets[name][rrtype].records = append(s.rrsets[name][rrtype].records, rr)
+	}
+	sort.Slice(s.names, func(i, j int) bool { return canonicalLess(s.names[i], s.names[j]) })
+
+	// Chain the names with NSEC records
+	for i, name := range s.names {
+		nsec := &dns.NSEC{Hdr: header(name, dns.TypeNSEC), NextDomain: s.names[(i+1)%len(s.names)]}
+		for rrtype := range s.rrsets[name] {
+			nsec.TypeBitMap = append(nsec.TypeBitMap, rrtype)
+		}
+		nsec.TypeBitMap = append(nsec.TypeBitMap, dns.TypeRRSIG, dns.TypeNSEC)
+		sort.Slice(nsec.TypeBitMap, func(i, j int) bool { return nsec.TypeBitMap[i] < nsec.TypeBitMap[j] })
+		s.rrsets[name][dns.TypeNSEC] = &signedRRset{records: []dns.RR{nsec}}
+	}
+
+	inception := time.Now().Add(-time.Hour)
+	for _, rrsets := range s.rrsets {
+		for rrtype, rrset := range rrsets {
+			rrset.rrsig = &dns.RRSIG{
+				Hdr:         header(rrset.records[0].Header().Name, dns.TypeRRSIG),
+				TypeCovered: rrtype,
+				Algorithm:   key.Algorithm,
+				OrigTtl:     uint32(authTTL),
+				Inception:   uint32(inception.Unix()),
+				Expiration:  uint32(inception.Add(authSignatureValidity).Unix()),
+				KeyTag:      key.KeyTag(),
+				SignerName:  origin,
+			}
+			if err := rrset.rrsig.Sign(signer, rrset.records); err != nil {
+				return nil, fmt.Errorf("unable to sign %s %s: %s", rrset.records[0].Header().Name, typeName(rrtype), err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// canonicalLess tells whether name a sorts before name b in the canonical DNS order (RFC 4034)
+func canonicalLess(a, b string) bool {
+	labelsA, labelsB := canonicalLabels(a), canonicalLabels(b)
+	for i := 1; i <= len(labelsA) && i <= len(labelsB); i++ {
+		if c := bytes.Compare(labelsA[len(labelsA)-i], labelsB[len(labelsB)-i]); c != 0 {
+			return c < 0
+		}
+	}
+	return len(labelsA) < len(labelsB)
+}
+
+// canonicalLabels returns the labels of the name, in lowercase wire format
+func canonicalLabels(name string) [][]byte {
+	wire := make([]byte, 256)
+	length, err := dns.PackDomainName(dns.Fqdn(name), wire, 0, nil, false)
+	if err != nil {
+		// Not a valid name: compare it as a whole
+		return [][]byte{[]byte(strings.ToLower(name))}
+	}
+	var labels [][]byte
+	for i := 0; i < length && wire[i] > 0 && i+1+int(wire[i]) <= length; i += int(wire[i]) + 1 {
+		label := wire[i+1 : i+1+int(wire[i])]
+		for j, c := range label {
+			if c >= 'A' && c <= 'Z' {
+				label[j] = c + 'a' - 'A'
+			}
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// covering returns the NSEC RRset whose range covers the name, which is not in the zone
+func (s *authServer) covering(name string) *signedRRset {
+	next := sort.Search(len(s.names), func(i int) bool { return canonicalLess(name, s.names[i]) })
+	// The apex sorts first, and names of the zone are never before it
+	return s.rrsets[s.names[next-1]][dns.TypeNSEC]
+}
+
+// closestEncloser returns the longest name of the zone that is an ancestor of the name
+func (s *authServer) closestEncloser(name string) string {
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if _, ok := s.rrsets[name[i:]]; ok {
+			return name[i:]
+		}
+	}
+	return s.origin
+}
+
+// ServeDNS answers a query for the test zone
+func (s *authServer) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
+	response := new(dns.Msg)
+	if len(request.Question) != 1 {
+		w.WriteMsg(response.SetRcode(request, dns.RcodeFormatError))
+		return
+	}
+	question := request.Question[0]
+	name := dns.CanonicalName(question.Name)
+	if !dns.IsSubDomain(s.origin, name) {
+		w.WriteMsg(response.SetRcode(request, dns.RcodeRefused))
+		return
+	}
+	s.queries.record()
+	s.amplification.record(true, question.Qtype, name)
+	s.herd.record(name, question.Qtype)
+	if !s.outage.disrupt(w, request) {
+		return
+	}
+
+	response.SetReply(request)
+	response.Authoritative = true
+	dnssec := false
+	if opt := request.IsEdns0(); opt != nil {
+		dnssec = opt.Do()
+		response.SetEdns0(dns.DefaultMsgSize, dnssec)
+	}
+	add := func(section *[]dns.RR, rrset *signedRRset) {
+		*section = append(*section, rrset.records...)
+		if dnssec {
+			*section = append(*section, rrset.rrsig)
+		}
+	}
+
+	soa := s.rrsets[s.origin][dns.TypeSOA]
+	if rrsets, ok := s.rrsets[name]; ok {
+		if rrset, ok := rrsets[question.Qtype]; ok {
+			add(&response.Answer, rrset)
+		} else {
+			// The name exists, but has no record of this type
+			add(&response.Ns, soa)
+			if dnssec {
+				add(&response.Ns, rrsets[dns.TypeNSEC])
+			}
+		}
+	} else {
+		// Prove that neither the name nor a wildcard matching it exist
+		response.Rcode = dns.RcodeNameError
+		add(&response.Ns, soa)
+		if dnssec {
+			nameProof := s.covering(name)
+			add(&response.Ns, nameProof)
+			if wildcardProof := s.covering("*." + s.closestEncloser(name)); wildcardProof != nameProof {
+				add(&response.Ns, wildcardProof)
+			}
+		}
+	}
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := request.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		response.Truncate(size)
+	}
+	w.WriteMsg(response)
+}
+
+// listen starts answering the queries received over UDP and TCP on the address
+func (s *authServer) listen(address string) error {
+	packetConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		packetConn.Close()
+		return err
+	}
+	go (&dns.Server{PacketConn: packetConn, Handler: s}).ActivateAndServe()
+	go (&dns.Server{Listener: listener, Handler: s}).ActivateAndServe()
+	return nil
+}
+
+// loadZoneKey reads the key signing the test zone from the file, or generates a new one and
+// saves it to the file when it does not exist yet (or only keeps it in memory without file)
+func loadZoneKey(path string, origin string) (*dns.DNSKEY, crypto.Signer, error) {
+	if path != "" {
+		if f, err := os.Open(path); err == nil {
+			defer f.Close()
+			return readZoneKey(f, path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.CanonicalName(origin), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: uint32(authTTL)},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		return nil, nil, err
+	}
+	if path != "" {
+		// The public key on the first line, followed by the private key
+		content := key.String() + "\n" + key.PrivateKeyString(private)
+		if err = os.WriteFile(path, []byte(content), 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+	return key, private.(crypto.Signer), nil
+}
+
+// readZoneKey reads a key saved by loadZoneKey
+func readZoneKey(f *os.File, path string) (*dns.DNSKEY, crypto.Signer, error) {
+	reader := bufio.NewReader(f)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	rr, err := dns.NewRR(line)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s does not start with a DNSKEY record", path)
+	}
+	private, err := key.ReadPrivateKey(reader, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key in %s", path)
+	}
+	return key, signer, nil
+}
+
+// startAuthServer builds the test zone and starts the built-in authoritative server
+func startAuthServer() (*authServer, error) {
+	host, _, err := net.SplitHostPort(authAddress)
+	if err != nil {
+		return nil, err
+	}
+	nsAddress := net.ParseIP(host)
+	if nsAddress == nil || nsAddress.IsUnspecified() {
+		nsAddress = net.IPv4(127, 0, 0, 1)
+	}
+	key, signer, err := loadZoneKey(authKeyFile, authZoneName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the key of the zone: %s", err)
+	}
+	if dns.CanonicalName(key.Header().Name) != dns.CanonicalName(authZoneName) {
+		return nil, fmt.Errorf("the key is for zone %s", key.Header().Name)
+	}
+	server, err := newAuthServer(authZoneName, authNames, nsAddress, key, signer)
+	if err != nil {
+		return nil, err
+	}
+	if outageMode != "" {
+		server.outage = newOutageSchedule(time.Now())
+	}
+	if err = server.listen(authAddress); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// randomLabel returns a random label, of the kind found in the test zone
+func randomLabel(random *rand.Rand) string {
+	label := make([]byte, authLabelLength)
+	for i := range label {
+		label[i] = authLabelAlphabet[random.Intn(len(authLabelAlphabet))]
+	}
+	return string(label)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// responseRecorder keeps the message written by a handler
+type responseRecorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (r *responseRecorder) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53000}
+}
+
+func (r *responseRecorder) WriteMsg(m *dns.Msg) error {
+	r.msg = m
+	return nil
+}
+
+func newTestAuthServer(t *testing.T) *authServer {
+	authTTL = 300
+	key, signer, err := loadZoneKey("", "stress.test.")
+	if err != nil {
+		t.Fatalf("Unable to generate the key: %s", err)
+	}
+	server, err := newAuthServer("Stress.Test", 50, net.IPv4(127, 0, 0, 1), key, signer)
+	if err != nil {
+		t.Fatalf("Unable to build the zone: %s", err)
+	}
+	return server
+}
+
+// exchangeAuth sends a query with the DO bit to the server
+func exchangeAuth(server *authServer, name string, qtype uint16) *dns.Msg {
+	recorder := &responseRecorder{}
+	server.ServeDNS(recorder, new(dns.Msg).SetQuestion(name, qtype).SetEdns0(1232, true))
+	return recorder.msg
+}
+
+// verifySignatures checks the signature of every RRset of the section
+func verifySignatures(t *testing.T, key *dns.DNSKEY, section []dns.RR) {
+	rrsets := make(map[uint16][]dns.RR)
+	var rrsigs []*dns.RRSIG
+	for _, rr := range section {
+		if rrsig, ok := rr.(*dns.RRSIG); ok {
+			rrsigs = append(rrsigs, rrsig)
+		} else {
+			rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+		}
+	}
+	for _, rrsig := range rrsigs {
+		var rrset []dns.RR
+		for _, rr := range rrsets[rrsig.TypeCovered] {
+			if rr.Header().Name == rrsig.Header().Name {
+				rrset = append(rrset, rr)
+			}
+		}
+		if err := rrsig.Verify(key, rrset); err != nil {
+			t.Errorf("Invalid signature of %s %s: %s", rrsig.Header().Name, typeName(rrsig.TypeCovered), err)
+		}
+	}
+}
+
+func TestAuthServerAnswers(t *testing.T) {
+	server := newTestAuthServer(t)
+	if len(server.names) != 52 || server.names[0] != "stress.test." {
+		t.Fatalf("Invalid names: %v", server.names)
+	}
+
+	response := exchangeAuth(server, server.names[10], dns.TypeA)
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 2 || !response.Authoritative {
+		t.Fatalf("Invalid answer: %s", response)
+	}
+	verifySignatures(t, server.key, response.Answer)
+
+	response = exchangeAuth(server, server.names[10], dns.TypeAAAA)
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 || len(response.Ns) != 4 {
+		t.Fatalf("Invalid empty answer: %s", response)
+	}
+	verifySignatures(t, server.key, response.Ns)
+
+	response = exchangeAuth(server, "example.com.", dns.TypeA)
+	if response.Rcode != dns.RcodeRefused {
+		t.Errorf("Queries out of the zone should be refused: %s", response)
+	}
+
+	if queries := server.queries.take(); queries != 2 {
+		t.Errorf("Invalid number of queries: got %d, expected 2", queries)
+	}
+}
+
+func TestAuthServerDenialOfExistence(t *testing.T) {
+	server := newTestAuthServer(t)
+	for _, name := range []string{"0000.stress.test.", "zzzz.stress.test.", "a.b." + server.names[20]} {
+		response := exchangeAuth(server, name, dns.TypeA)
+		if response.Rcode != dns.RcodeNameError {
+			t.Fatalf("%s should not exist: %s", name, response)
+		}
+		verifySignatures(t, server.key, response.Ns)
+
+		// The NSEC records must cover the name and the wildcard of its closest encloser
+		covered := map[string]bool{name: false, "*." + server.closestEncloser(name): false}
+		for _, rr := range response.Ns {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok {
+				continue
+			}
+			for proven := range covered {
+				if canonicalLess(nsec.Hdr.Name, proven) &&
+					(canonicalLess(proven, nsec.NextDomain) || nsec.NextDomain == server.origin) {
+					covered[proven] = true
+				}
+			}
+		}
+		for proven, ok := range covered {
+			if !ok {
+				t.Errorf("%s is not covered by an NSEC record: %s", proven, response)
+			}
+		}
+	}
+}
+
+func TestCanonicalLess(t *testing.T) {
+	// Example of RFC 4034, section 6.1
+	names := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.",
+		"z.example.", "\\001.z.example.", "*.z.example.", "\\200.z.example."}
+	for i := 0; i < len(names)-1; i++ {
+		if !canonicalLess(names[i], names[i+1]) || canonicalLess(names[i+1], names[i]) {
+			t.Errorf("%s should sort before %s", names[i], names[i+1])
+		}
+	}
+}
+
+func TestZoneKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone.key")
+	key, signer, err := loadZoneKey(path, "stress.test.")
+	if err != nil {
+		t.Fatalf("Unable to generate the key: %s", err)
+	}
+	loaded, loadedSigner, err := loadZoneKey(path, "stress.test.")
+	if err != nil {
+		t.Fatalf("Unable to load the key: %s", err)
+	}
+	if loaded.PublicKey != key.PublicKey || loaded.KeyTag() != key.KeyTag() {
+		t.Errorf("Invalid key: got %s, expected %s", loaded, key)
+	}
+	if !loadedSigner.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(signer.Public()) {
+		t.Error("The private key was not loaded")
+	}
+}
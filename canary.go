@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/miekg/dns"
+)
+
+// Canary options
+var (
+	// Path to the list of queries of the canary, in the format of -dataFile
+	canaryFile string
+	// Rate of the canary queries
+	canaryRate float64
+)
+
+// Maximum number of canary queries waiting for their answer at the same time, beyond which
+// the next ones are skipped
+const canaryInFlight = 100
+
+// canaryProbe is the result of a canary query
+type canaryProbe struct {
+	elapsed time.Duration
+	failed  bool
+	// Not sent, because of too many queries without answer
+	skipped bool
+}
+
+// canaryStats are the stats of the canary queries
+type canaryStats struct {
+	probes    int
+	failures  int
+	latencies latencyHistogram
+	max       time.Duration
+}
+
+// record adds a canary query to the stats
+func (s *canaryStats) record(probe *canaryProbe) {
+	s.probes++
+	if probe.failed || probe.skipped {
+		s.failures++
+	}
+	if probe.skipped {
+		return
+	}
+	s.latencies.record(probe.elapsed)
+	if probe.elapsed > s.max {
+		s.max = probe.elapsed
+	}
+}
+
+// canarySummary sums up the canary queries of the run
+type canarySummary struct {
+	Probes   int           `json:"probes"`
+	Failures int           `json:"failures"`
+	P50      time.Duration `json:"p50"`
+	P99      time.Duration `json:"p99"`
+	Max      time.Duration `json:"max"`
+}
+
+func (s *canaryStats) summary() *canarySummary {
+	return &canarySummary{
+		Probes:   s.probes,
+		Failures: s.failures,
+		P50:      s.latencies.percentile(50),
+		P99:      s.latencies.percentile(99),
+		Max:      s.max,
+	}
+}
+
+// loadCanary reads the queries of the canary
+func loadCanary(path string) ([]query, error) {
+	if canaryRate <= 0 {
+		return nil, fmt.Errorf("the rate must be positive")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	queries, err := readQueries(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries in %s", path)
+	}
+	return queries, nil
+}
+
+// canaryClient sends the canary queries, keeping the transports of each kind of the mix open
+// once they got an answer
+type canaryClient struct {
+	events *transportEvents
+	idle   []chan transport
+}
+
+func newCanaryClient() *canaryClient {
+	c := &canaryClient{events: &transportEvents{}, idle: make([]chan transport, len(transportMix))}
+	for i := range c.idle {
+		c.idle[i] = make(chan transport, canaryInFlight)
+	}
+	return c
+}
+
+// probe sends a canary query with a transport of the mix, and waits for its answer
+func (c *canaryClient) probe(q query, index int) *canaryProbe {
+	share := transportMix[index]
+	var t transport
+	select {
+	case t = <-c.idle[index]:
+	default:
+		var err error
+		if t, err = newTransport(share.name, share.address, c.events); err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to create the transport", err))
+			os.Exit(2)
+		}
+	}
+	message := new(dns.Msg).SetQuestion(q.domain, q.recordType)
+	if iterative {
+		message.RecursionDesired = false
+	}
+	if authoritative != nil {
+		authoritative.amplification.record(false, q.recordType, q.domain)
+	}
+
+	start := time.Now()
+	response, err := t.exchange(message)
+	probe := &canaryProbe{elapsed: time.Since(start)}
+	if err != nil {
+		probe.failed = true
+		if verbose {
+			fmt.Printf("Canary %s error: %s (%s %s)\n", q.domain, err, share.name, share.address)
+		}
+		t.close()
+		return probe
+	}
+	probe.failed = response.Rcode == dns.RcodeServerFailure
+	c.idle[index] <- t
+	return probe
+}
+
+// runCanary sends the canary queries in turn at the canary rate, alongside the load of the
+// workers, and reports each of them to the stats module. Each query is sent on time even
+// when the previous ones are still waiting for their answer, like the queries of unrelated
+// users would be.
+func runCanary(queries []query, channel chan<- statsMessage) {
+	client := newCanaryClient()
+	random := mrand.New(mrand.NewSource(runSeed - 2))
+	inFlight := make(chan struct{}, canaryInFlight)
+
+	interval := time.Duration(float64(time.Second) / canaryRate)
+	next := time.Now()
+	for i := 0; ; i++ {
+		q := queries[i%len(queries)]
+		index := pickTransport(random)
+
+		time.Sleep(time.Until(next))
+		next = next.Add(interval)
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			// Too many queries without answer: the resolver is not answering anyway
+			channel <- statsMessage{canary: &canaryProbe{skipped: true}}
+			continue
+		}
+
+		go func() {
+			defer func() { <-inFlight }()
+			channel <- statsMessage{canary: client.probe(q, index)}
+		}()
+	}
+}
+
+// printCanarySummary prints the summary of the canary queries
+func printCanarySummary(s *canarySummary) {
+	fmt.Printf("  Canary: %d queries", s.Probes)
+	if s.Probes > 0 {
+		fmt.Printf(
+			", %.1f%% answered (p50=%.1fms / p99=%.1fms / max=%.1fms)",
+			100*float64(s.Probes-s.Failures)/float64(s.Probes),
+			1000.*s.P50.Seconds(),
+			1000.*s.P99.Seconds(),
+			1000.*s.Max.Seconds(),
+		)
+	}
+	if s.Failures > 0 {
+		fmt.Printf("\t %s", aurora.Red(fmt.Sprintf("Errors: %d", s.Failures)))
+	}
+	fmt.Print("\n")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanaryStats(t *testing.T) {
+	var stats canaryStats
+	stats.record(&canaryProbe{elapsed: 10 * time.Millisecond})
+	stats.record(&canaryProbe{elapsed: 30 * time.Millisecond, failed: true})
+	stats.record(&canaryProbe{skipped: true})
+
+	summary := stats.summary()
+	if summary.Probes != 3 || summary.Failures != 2 {
+		t.Errorf("Invalid summary: %d queries, %d failures", summary.Probes, summary.Failures)
+	}
+	// Skipped queries have no latency
+	if stats.latencies.total != 2 || summary.Max != 30*time.Millisecond {
+		t.Errorf("Invalid latencies: %d, max=%s", stats.latencies.total, summary.Max)
+	}
+}
+
+func TestCanaryProbe(t *testing.T) {
+	server := newTestAuthServer(t)
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go (&dns.Server{PacketConn: packetConn, Handler: server}).ActivateAndServe()
+	defer packetConn.Close()
+
+	transportMix = []transportShare{{name: transportUDP, address: packetConn.LocalAddr().String(), weight: 1}}
+	defer func() { transportMix = nil }()
+
+	client := newCanaryClient()
+	q := query{domain: server.names[0], recordType: dns.TypeA}
+	for i := 0; i < 3; i++ {
+		if probe := client.probe(q, 0); probe.failed || probe.elapsed <= 0 {
+			t.Fatalf("Invalid canary query: %+v", probe)
+		}
+	}
+	// The transport is kept open between the queries
+	if idle := len(client.idle[0]); idle != 1 {
+		t.Errorf("Invalid number of idle transports: got %d, expected 1", idle)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Disruptions the chaos module can inject in the connections of stream transports
+const (
+	// chaosReset aborts the connection with a TCP RST
+	chaosReset = "reset"
+	// chaosHalfClose shuts down the sending side of the connection, like a draining load
+	// balancer would
+	chaosHalfClose = "halfclose"
+	// chaosStall pauses the reading of the next response in the middle of it
+	chaosStall = "stall"
+)
+
+var chaosModes = map[string]bool{
+	chaosReset:     true,
+	chaosHalfClose: true,
+	chaosStall:     true,
+}
+
+// disruptionTracker remembers when the connections of a transport were last disrupted,
+// so that the worker can measure how long it took to get an answer again.
+type disruptionTracker struct {
+	mu    sync.Mutex
+	since time.Time
+}
+
+// disrupt records a disruption, unless an earlier one has not been recovered yet
+func (d *disruptionTracker) disrupt() {
+	d.mu.Lock()
+	if d.since.IsZero() {
+		d.since = time.Now()
+	}
+	d.mu.Unlock()
+}
+
+// pending tells whether a disruption has not been recovered yet
+func (d *disruptionTracker) pending() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.since.IsZero()
+}
+
+// take returns the time of the pending disruption (or the zero time), and forgets it
+func (d *disruptionTracker) take() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	since := d.since
+	d.since = time.Time{}
+	return since
+}
+
+// errHalfClosed is returned by the writes on a half-closed connection
+var errHalfClosed = errors.New("connection half-closed by the chaos module")
+
+// chaosConn is a connection that the chaos module can disrupt
+type chaosConn struct {
+	net.Conn
+	tracker *disruptionTracker
+	// stall is set to 1 when the next read must be stalled
+	stall int32
+	// halfClosed is set to 1 once the sending side of the connection is shut down
+	halfClosed int32
+}
+
+// Connections currently open, among which the chaos module picks its victims
+var chaosConns = struct {
+	sync.Mutex
+	conns map[*chaosConn]struct{}
+}{conns: make(map[*chaosConn]struct{})}
+
+func newChaosConn(conn net.Conn, tracker *disruptionTracker) *chaosConn {
+	c := &chaosConn{Conn: conn, tracker: tracker}
+	chaosConns.Lock()
+	chaosConns.conns[c] = struct{}{}
+	chaosConns.Unlock()
+	return c
+}
+
+func (c *chaosConn) Read(p []byte) (int, error) {
+	if len(p) > 1 && atomic.CompareAndSwapInt32(&c.stall, 1, 0) {
+		// Only read the beginning of the response, and wait before reading the rest of it
+		n, err := c.Conn.Read(p[:1])
+		c.tracker.disrupt()
+		time.Sleep(chaosStallDuration)
+		return n, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *chaosConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.halfClosed) == 1 {
+		// Whatever the underlying connection, nothing can be sent after a half-close
+		return 0, errHalfClosed
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *chaosConn) Close() error {
+	chaosConns.Lock()
+	delete(chaosConns.conns, c)
+	chaosConns.Unlock()
+	return c.Conn.Close()
+}
+
+// disrupt applies the chaos mode to the connection
+func (c *chaosConn) disrupt(mode string) {
+	switch mode {
+	case chaosReset:
+		c.tracker.disrupt()
+		if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+			// Discard unsent data and send a RST instead of a FIN
+			tcpConn.SetLinger(0)
+		}
+		c.Close()
+	case chaosHalfClose:
+		c.tracker.disrupt()
+		atomic.StoreInt32(&c.halfClosed, 1)
+		if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	case chaosStall:
+		// The disruption is only recorded once the read is actually stalled
+		atomic.StoreInt32(&c.stall, 1)
+	}
+}
+
+// runChaos periodically disrupts a share of the open connections, and reports the number
+// of disruptions to the stats module.
+func runChaos(channel chan<- statsMessage) {
+	ticker := time.NewTicker(chaosInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var victims []*chaosConn
+		chaosConns.Lock()
+		for c := range chaosConns.conns {
+			if rand.Float64() < chaosRatio {
+				victims = append(victims, c)
+			}
+		}
+		chaosConns.Unlock()
+
+		for _, c := range victims {
+			c.disrupt(chaosMode)
+		}
+		if verbose {
+			fmt.Printf("Chaos: %s applied to %d connections.\n", chaosMode, len(victims))
+		}
+		channel <- statsMessage{disruptions: len(victims)}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestChaosConn returns a chaos connection over a pipe, and the other end of the pipe
+func newTestChaosConn(t *testing.T) (*chaosConn, net.Conn, *disruptionTracker) {
+	client, server := net.Pipe()
+	tracker := &disruptionTracker{}
+	conn := newChaosConn(client, tracker)
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+	})
+	return conn, server, tracker
+}
+
+func TestChaosReset(t *testing.T) {
+	conn, _, tracker := newTestChaosConn(t)
+	conn.disrupt(chaosReset)
+
+	if _, err := conn.Write([]byte("query")); err == nil {
+		t.Error("The reset connection should not be writable")
+	}
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Error("The reset connection should not be readable")
+	}
+	chaosConns.Lock()
+	_, open := chaosConns.conns[conn]
+	chaosConns.Unlock()
+	if open {
+		t.Error("The reset connection is still among the open connections")
+	}
+	checkDisruption(t, tracker)
+}
+
+func TestChaosHalfClose(t *testing.T) {
+	conn, server, tracker := newTestChaosConn(t)
+	conn.disrupt(chaosHalfClose)
+
+	if _, err := conn.Write([]byte("query")); err != errHalfClosed {
+		t.Errorf("Invalid error writing on the half-closed connection: %v", err)
+	}
+	// The resolver may still send what it has to
+	go server.Write([]byte("answer"))
+	buffer := make([]byte, 16)
+	if n, err := conn.Read(buffer); err != nil || string(buffer[:n]) != "answer" {
+		t.Errorf("Invalid read on the half-closed connection: %q (%v)", buffer[:n], err)
+	}
+	checkDisruption(t, tracker)
+}
+
+func TestChaosStall(t *testing.T) {
+	chaosStallDuration = 20 * time.Millisecond
+	defer func() { chaosStallDuration = 0 }()
+	conn, server, tracker := newTestChaosConn(t)
+	conn.disrupt(chaosStall)
+	if tracker.pending() {
+		t.Error("The stall should only be recorded once a read is stalled")
+	}
+
+	go server.Write([]byte("answer"))
+	buffer := make([]byte, 16)
+	start := time.Now()
+	n, err := conn.Read(buffer)
+	if err != nil || n != 1 {
+		t.Fatalf("The stalled read should only return the first byte: %q (%v)", buffer[:n], err)
+	}
+	if elapsed := time.Since(start); elapsed < chaosStallDuration {
+		t.Errorf("The read was stalled for %s, expected %s", elapsed, chaosStallDuration)
+	}
+	// Only the next read is stalled
+	if n, err = conn.Read(buffer); err != nil || string(buffer[:n]) != "nswer" {
+		t.Errorf("Invalid read after the stall: %q (%v)", buffer[:n], err)
+	}
+	checkDisruption(t, tracker)
+}
+
+// checkDisruption checks that a single disruption was recorded, and forgotten once taken
+func checkDisruption(t *testing.T, tracker *disruptionTracker) {
+	t.Helper()
+	if !tracker.pending() {
+		t.Fatal("The disruption is not pending")
+	}
+	since := tracker.take()
+	if since.IsZero() || time.Since(since) > time.Second {
+		t.Errorf("Invalid time of the disruption: %s", since)
+	}
+	if tracker.pending() || !tracker.take().IsZero() {
+		t.Error("The disruption should be forgotten once taken")
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/miekg/dns"
+)
+
+// Actions of the corpus subcommand, with their description
+var corpusActions = map[string]string{
+	"dedupe":    "Remove the duplicate queries (names are compared case-insensitively)",
+	"shuffle":   "Shuffle the queries",
+	"sample":    "Keep a random sample of the queries",
+	"filter":    "Keep the queries matching query types or name suffixes",
+	"split":     "Split the queries into several files",
+	"merge":     "Merge several query files, one after the other or interleaved",
+	"stats":     "Display statistics about the queries",
+	"anonymize": "Replace the names below their public suffix with a keyed hash",
+}
+
+// corpusUsage prints the usage of the corpus subcommand
+func corpusUsage() {
+	var actions []string
+	for action := range corpusActions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	fmt.Fprint(os.Stderr, strings.Join([]string{
+		"Prepare the query files given to -dataFile. The queries are read from the files, or from",
+		"the standard input when none is given.",
+		"",
+		"Usage: dnsstresss corpus action [option ...] [file ...]",
+		"",
+		"Actions:",
+		"",
+	}, "\n"))
+	for _, action := range actions {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", action, corpusActions[action])
+	}
+	fmt.Fprint(os.Stderr, "\nRun 'dnsstresss corpus action -h' for the options of an action.\n")
+}
+
+// corpusCommand implements the corpus subcommand, and returns the exit code
+func corpusCommand(args []string) int {
+	if len(args) == 0 || corpusActions[args[0]] == "" {
+		corpusUsage()
+		return 1
+	}
+	action := args[0]
+
+	flags := flag.NewFlagSet("corpus "+action, flag.ExitOnError)
+	output := flags.String("o", "", "Output file (default: standard output)")
+	seed := flags.Int64("seed", 0, "Seed of the random generator (default: random)")
+	var count, parts, lines int
+	var ratio float64
+	var qtypes, suffixes string
+	var invert, interleave bool
+	var key, suffixFile string
+	var preserveLength, preserveStructure bool
+	switch action {
+	case "sample":
+		flags.IntVar(&count, "n", 0, "Number of queries to keep")
+		flags.Float64Var(&ratio, "ratio", 0, "Share of the queries to keep, between 0 and 1 (instead of -n)")
+	case "filter":
+		flags.StringVar(&qtypes, "qtype", "", "Comma-separated list of query types to keep (e.g. A,AAAA)")
+		flags.StringVar(&suffixes, "suffix", "", "Comma-separated list of name suffixes to keep (e.g. example.com)")
+		flags.BoolVar(&invert, "invert", false, "Keep the queries that do not match instead")
+	case "split":
+		flags.IntVar(&parts, "parts", 0, "Number of files to split the queries into")
+		flags.IntVar(&lines, "lines", 0, "Number of queries per file (instead of -parts)")
+		flags.Lookup("o").Usage = "Prefix of the output files, numbered from 000 (default: corpus-)"
+	case "anonymize":
+		flags.StringVar(&key, "key", "", "Secret key of the hash: the same key always gives the same names")
+		flags.StringVar(&suffixes, "suffix", "", "Comma-separated list of public suffixes kept as is (default: the TLD only)")
+		flags.StringVar(&suffixFile, "suffixFile", "", "File with the public suffixes kept as is, in the format of the Public Suffix List")
+		flags.BoolVar(&preserveLength, "preserveLength", false, "Keep the length of the labels")
+		flags.BoolVar(&preserveStructure, "preserveStructure", false, "Keep the length of the labels and the position of their digits, hyphens and underscores")
+	case "merge":
+		flags.BoolVar(&interleave, "interleave", false, "Interleave the queries of the files instead of concatenating them")
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n\nUsage: dnsstresss corpus %s [option ...] [file ...]\n", corpusActions[action], action)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args[1:])
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	random := rand.New(rand.NewSource(*seed))
+
+	inputs, err := readCorpusFiles(flags.Args())
+	if err != nil {
+		fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to read the queries", err))
+		return 2
+	}
+	var queries []query
+	for _, input := range inputs {
+		queries = append(queries, input...)
+	}
+
+	switch action {
+	case "dedupe":
+		queries = dedupeQueries(queries)
+	case "shuffle":
+		random.Shuffle(len(queries), func(i, j int) { queries[i], queries[j] = queries[j], queries[i] })
+	case "sample":
+		if ratio > 0 {
+			count = int(ratio * float64(len(queries)))
+		}
+		if count <= 0 {
+			fmt.Println(aurora.Red("The sample size must be given with -n or -ratio"))
+			return 2
+		}
+		queries = sampleQueries(queries, count, random)
+	case "filter":
+		queries, err = filterQueries(queries, splitList(qtypes), splitList(suffixes), invert)
+	case "merge":
+		if interleave {
+			queries = interleaveQueries(inputs)
+		}
+	case "split":
+		prefix := *output
+		if prefix == "" {
+			prefix = "corpus-"
+		}
+		err = splitQueries(queries, prefix, parts, lines)
+	case "stats":
+		err = printCorpusStats(os.Stdout, queries)
+	case "anonymize":
+		err = anonymizeQueries(queries, key, splitList(suffixes), suffixFile, preserveLength, preserveStructure)
+	}
+	if err != nil {
+		fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to "+action+" the queries", err))
+		return 2
+	}
+	if action == "split" || action == "stats" {
+		return 0
+	}
+
+	if err = writeCorpusFile(*output, queries); err != nil {
+		fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to write the queries", err))
+		return 2
+	}
+	return 0
+}
+
+// readCorpusFiles reads the queries of each file, or of the standard input when there is none
+func readCorpusFiles(paths []string) ([][]query, error) {
+	if len(paths) == 0 {
+		queries, err := readQueries(os.Stdin)
+		return [][]query{queries}, err
+	}
+	var inputs [][]query
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		queries, err := readQueries(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		inputs = append(inputs, queries)
+	}
+	return inputs, nil
+}
+
+// writeCorpusFile writes the queries to the file, or to the standard output when path is empty
+func writeCorpusFile(path string, queries []query) error {
+	if path == "" {
+		return writeQueries(os.Stdout, queries)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = writeQueries(f, queries); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// dedupeQueries removes the duplicate queries, keeping the first occurrence of each
+func dedupeQueries(queries []query) []query {
+	seen := make(map[query]bool)
+	var unique []query
+	for _, q := range queries {
+		key := query{domain: strings.ToLower(q.domain), recordType: q.recordType}
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, q)
+		}
+	}
+	return unique
+}
+
+// sampleQueries returns count queries picked at random, in their original order
+func sampleQueries(queries []query, count int, random *rand.Rand) []query {
+	if count >= len(queries) {
+		return queries
+	}
+	picked := random.Perm(len(queries))[:count]
+	sort.Ints(picked)
+	sample := make([]query, count)
+	for i, index := range picked {
+		sample[i] = queries[index]
+	}
+	return sample
+}
+
+// filterQueries keeps the queries of the given types and under the given suffixes (any type
+// or suffix when the list is empty), or the other ones when invert is set
+func filterQueries(queries []query, qtypes []string, suffixes []string, invert bool) ([]query, error) {
+	types := make(map[uint16]bool)
+	for _, name := range qtypes {
+		recordType, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type %q", name)
+		}
+		types[recordType] = true
+	}
+	for i, suffix := range suffixes {
+		suffixes[i] = strings.ToLower(dns.Fqdn(suffix))
+	}
+
+	var kept []query
+	for _, q := range queries {
+		match := len(types) == 0 || types[q.recordType]
+		if match && len(suffixes) > 0 {
+			match = false
+			for _, suffix := range suffixes {
+				if dns.IsSubDomain(suffix, strings.ToLower(q.domain)) {
+					match = true
+					break
+				}
+			}
+		}
+		if match != invert {
+			kept = append(kept, q)
+		}
+	}
+	return kept, nil
+}
+
+// interleaveQueries merges the lists of queries, taking one query of each list in turn
+func interleaveQueries(inputs [][]query) []query {
+	var merged []query
+	for i := 0; ; i++ {
+		added := false
+		for _, input := range inputs {
+			if i < len(input) {
+				merged = append(merged, input[i])
+				added = true
+			}
+		}
+		if !added {
+			return merged
+		}
+	}
+}
+
+// splitQueries writes the queries to numbered files, either in a given number of files or
+// with a given number of queries per file
+func splitQueries(queries []query, prefix string, parts int, lines int) error {
+	if parts > 0 {
+		lines = (len(queries) + parts - 1) / parts
+	}
+	if lines <= 0 {
+		return fmt.Errorf("the size of the files must be given with -parts or -lines")
+	}
+	for part := 0; len(queries) > 0; part++ {
+		size := lines
+		if size > len(queries) {
+			size = len(queries)
+		}
+		path := fmt.Sprintf("%s%03d.txt", prefix, part)
+		if err := writeCorpusFile(path, queries[:size]); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d queries\n", path, size)
+		queries = queries[size:]
+	}
+	return nil
+}
+
+// anonymizeQueries replaces the names of the queries with their anonymized version
+func anonymizeQueries(queries []query, key string, suffixes []string, suffixFile string, preserveLength bool, preserveStructure bool) error {
+	if key == "" {
+		return fmt.Errorf("a secret key must be given with -key")
+	}
+	if suffixFile != "" {
+		f, err := os.Open(suffixFile)
+		if err != nil {
+			return err
+		}
+		listed, err := readSuffixes(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		suffixes = append(suffixes, listed...)
+	}
+
+	a := newAnonymizer(key, suffixes)
+	a.preserveLength = preserveLength
+	a.preserveStructure = preserveStructure
+	for i := range queries {
+		queries[i].domain = a.anonymize(queries[i].domain)
+	}
+	return nil
+}
+
+// printCorpusStats prints the number of queries and names, the mix of query types and the
+// distribution of the number of labels of the names
+func printCorpusStats(w io.Writer, queries []query) error {
+	names := make(map[string]bool)
+	types := make(map[uint16]int)
+	depths := make(map[int]int)
+	for _, q := range queries {
+		names[strings.ToLower(q.domain)] = true
+		types[q.recordType]++
+		depths[dns.CountLabel(q.domain)]++
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Queries:\t%d\n", len(queries))
+	fmt.Fprintf(tw, "Unique queries:\t%d\n", len(dedupeQueries(queries)))
+	fmt.Fprintf(tw, "Unique names:\t%d\n", len(names))
+	if len(queries) == 0 {
+		return tw.Flush()
+	}
+
+	fmt.Fprintln(tw, "\nQuery types:")
+	var sortedTypes []uint16
+	for recordType := range types {
+		sortedTypes = append(sortedTypes, recordType)
+	}
+	// Most frequent first
+	sort.Slice(sortedTypes, func(i, j int) bool {
+		if types[sortedTypes[i]] != types[sortedTypes[j]] {
+			return types[sortedTypes[i]] > types[sortedTypes[j]]
+		}
+		return sortedTypes[i] < sortedTypes[j]
+	})
+	for _, recordType := range sortedTypes {
+		count := types[recordType]
+		fmt.Fprintf(tw, "  %s\t%d\t%5.1f%%\n", typeName(recordType), count, 100*float64(count)/float64(len(queries)))
+	}
+
+	fmt.Fprintln(tw, "\nLabel depth:")
+	var sortedDepths []int
+	for depth := range depths {
+		sortedDepths = append(sortedDepths, depth)
+	}
+	sort.Ints(sortedDepths)
+	for _, depth := range sortedDepths {
+		count := depths[depth]
+		share := float64(count) / float64(len(queries))
+		fmt.Fprintf(tw, "  %d\t%d\t%5.1f%%\t%s\n", depth, count, 100*share, strings.Repeat("#", round(40*share)))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var testCorpus = []query{
+	{"www.example.com.", dns.TypeA},
+	{"WWW.Example.com.", dns.TypeA},
+	{"www.example.com.", dns.TypeAAAA},
+	{"mail.example.com.", dns.TypeMX},
+	{"example.net.", dns.TypeA},
+	{"notexample.com.", dns.TypeA},
+}
+
+func TestDedupeQueries(t *testing.T) {
+	unique := dedupeQueries(testCorpus)
+	expected := []query{testCorpus[0], testCorpus[2], testCorpus[3], testCorpus[4], testCorpus[5]}
+	if !reflect.DeepEqual(unique, expected) {
+		t.Errorf("Invalid unique queries: got %v", unique)
+	}
+}
+
+func TestFilterQueries(t *testing.T) {
+	cases := []struct {
+		qtypes   []string
+		suffixes []string
+		invert   bool
+		expected []query
+	}{
+		{[]string{"a"}, nil, false, []query{testCorpus[0], testCorpus[1], testCorpus[4], testCorpus[5]}},
+		// Suffixes match whole labels
+		{nil, []string{"example.com"}, false, []query{testCorpus[0], testCorpus[1], testCorpus[2], testCorpus[3]}},
+		{[]string{"A", "MX"}, []string{"example.com."}, false, []query{testCorpus[0], testCorpus[1], testCorpus[3]}},
+		{nil, []string{"example.com", "example.net"}, true, []query{testCorpus[5]}},
+	}
+	for _, c := range cases {
+		kept, err := filterQueries(testCorpus, c.qtypes, c.suffixes, c.invert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(kept, c.expected) {
+			t.Errorf("filterQueries(%v, %v, %v): got %v", c.qtypes, c.suffixes, c.invert, kept)
+		}
+	}
+	if _, err := filterQueries(testCorpus, []string{"NOTATYPE"}, nil, false); err == nil {
+		t.Error("Unknown query types should return a non-nil error")
+	}
+}
+
+func TestSampleQueries(t *testing.T) {
+	sample := sampleQueries(testCorpus, 3, rand.New(rand.NewSource(1)))
+	if len(sample) != 3 {
+		t.Fatalf("Invalid sample size %d", len(sample))
+	}
+	// The sample keeps the original order
+	last := -1
+	for _, q := range sample {
+		index := -1
+		for i, original := range testCorpus {
+			if original == q && i > last {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			t.Errorf("Query %v is not in order in the corpus", q)
+		}
+		last = index
+	}
+}
+
+func TestInterleaveQueries(t *testing.T) {
+	merged := interleaveQueries([][]query{testCorpus[:1], testCorpus[1:4], testCorpus[4:6]})
+	expected := []query{testCorpus[0], testCorpus[1], testCorpus[4], testCorpus[2], testCorpus[5], testCorpus[3]}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Invalid merged queries: got %v", merged)
+	}
+}
+
+func TestCorpusStats(t *testing.T) {
+	var output bytes.Buffer
+	if err := printCorpusStats(&output, testCorpus); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Queries:         6", "Unique queries:  5", "Unique names:    4", "A     4   66.7%", "3  4   66.7%"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("The stats should contain %q:\n%s", expected, output.String())
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// DNSCrypt options
+var (
+	// Name of the provider, used to fetch the certificates (e.g. 2.dnscrypt-cert.example.com)
+	dnscryptProvider string
+	// Hex-encoded Ed25519 public key of the provider, used to verify the certificates
+	dnscryptKey string
+	// dnscryptProviderKey is the decoded dnscryptKey
+	dnscryptProviderKey ed25519.PublicKey
+)
+
+// Constants of the DNSCrypt v2 protocol
+const (
+	dnscryptCertMagic     = "DNSC"
+	dnscryptResolverMagic = "r6fnvWj8"
+	// Encryption systems announced by the certificates
+	dnscryptXSalsa20  = 0x0001
+	dnscryptXChaCha20 = 0x0002
+	// Queries are padded to a multiple of this size, and to at least the minimum size over UDP
+	dnscryptPadding      = 64
+	dnscryptMinQuerySize = 256
+	// Length of the certificate fields, up to the end of the validity period
+	dnscryptCertSize = 124
+	dnscryptStamp    = "sdns://"
+)
+
+// isDNSCryptTransport tells whether the transport is one of the DNSCrypt ones
+func isDNSCryptTransport(name string) bool {
+	return name == transportDNSCrypt || name == transportDNSCryptTCP
+}
+
+// loadDNSCryptOptions checks the DNSCrypt options, and returns the resolver. When the resolver
+// is given as a DNS stamp, its address, provider name and key are read from the stamp.
+func loadDNSCryptOptions(input string) (string, error) {
+	if strings.HasPrefix(input, dnscryptStamp) {
+		address, provider, key, err := parseDNSCryptStamp(input)
+		if err != nil {
+			return input, err
+		}
+		input, dnscryptProvider, dnscryptProviderKey = address, provider, key
+	} else {
+		key, err := hex.DecodeString(strings.ReplaceAll(dnscryptKey, ":", ""))
+		if err != nil {
+			return input, fmt.Errorf("invalid provider key: %s", err)
+		}
+		dnscryptProviderKey = key
+	}
+
+	if dnscryptProvider == "" {
+		return input, errors.New("the DNSCrypt transports need a provider name (-dnscryptProvider)")
+	}
+	if len(dnscryptProviderKey) != ed25519.PublicKeySize {
+		return input, errors.New("the DNSCrypt transports need the 32-byte public key of the provider (-dnscryptKey)")
+	}
+	dnscryptProvider = dns.Fqdn(dnscryptProvider)
+	return input, nil
+}
+
+// parseDNSCryptStamp returns the address, provider name and provider key of a DNSCrypt stamp
+// (sdns://...)
+func parseDNSCryptStamp(stamp string) (string, string, ed25519.PublicKey, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(stamp, dnscryptStamp))
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid stamp: %s", err)
+	}
+	// Protocol identifier, then 64 bits of properties
+	if len(data) < 9 || data[0] != 0x01 {
+		return "", "", nil, errors.New("not a DNSCrypt stamp")
+	}
+	data = data[9:]
+
+	var fields [3][]byte
+	for i := range fields {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return "", "", nil, errors.New("truncated stamp")
+		}
+		fields[i], data = data[1:1+int(data[0])], data[1+int(data[0]):]
+	}
+	return string(fields[0]), string(fields[2]), ed25519.PublicKey(fields[1]), nil
+}
+
+// dnscryptCert is a certificate published by a resolver, giving the key and encryption
+// system to use for the queries
+type dnscryptCert struct {
+	esVersion   uint16
+	resolverKey [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+}
+
+// valid tells whether the certificate can be used at the given time
+func (c *dnscryptCert) valid(now time.Time) bool {
+	return !now.Before(c.notBefore) && now.Before(c.notAfter)
+}
+
+// parseDNSCryptCert parses a certificate, and verifies its signature with the provider key
+func parseDNSCryptCert(data []byte, providerKey ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(data) < dnscryptCertSize {
+		return nil, errors.New("truncated certificate")
+	}
+	if string(data[:4]) != dnscryptCertMagic {
+		return nil, errors.New("not a DNSCrypt certificate")
+	}
+	cert := &dnscryptCert{esVersion: binary.BigEndian.Uint16(data[4:])}
+	if cert.esVersion != dnscryptXSalsa20 && cert.esVersion != dnscryptXChaCha20 {
+		return nil, fmt.Errorf("unsupported encryption system %#04x", cert.esVersion)
+	}
+	// The signature covers everything after it, extensions included
+	if !ed25519.Verify(providerKey, data[72:], data[8:72]) {
+		return nil, errors.New("invalid certificate signature")
+	}
+	copy(cert.resolverKey[:], data[72:104])
+	copy(cert.clientMagic[:], data[104:112])
+	cert.serial = binary.BigEndian.Uint32(data[112:])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(data[116:])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(data[120:])), 0)
+	return cert, nil
+}
+
+// unescapeTXT decodes a TXT string as presented by the dns library, which escapes the
+// non-printable bytes as \DDD
+func unescapeTXT(s string) []byte {
+	var data []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			data = append(data, s[i])
+			continue
+		}
+		if i+3 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+4], 10, 8); err == nil {
+				data = append(data, byte(b))
+				i += 3
+				continue
+			}
+		}
+		data = append(data, s[i+1])
+		i++
+	}
+	return data
+}
+
+// fetchDNSCryptCert asks the resolver for the certificates of the provider, and returns the
+// valid one with the highest serial number
+func fetchDNSCryptCert(address string, network string) (*dnscryptCert, error) {
+	client := &dns.Client{Net: network, Timeout: exchangeTimeout}
+	message := new(dns.Msg).SetQuestion(dnscryptProvider, dns.TypeTXT)
+	response, _, err := client.Exchange(message, address)
+	if err == nil && response.Truncated && network != transportTCP {
+		client.Net = transportTCP
+		response, _, err = client.Exchange(message, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the certificates: %s", err)
+	}
+
+	var best *dnscryptCert
+	now := time.Now()
+	for _, rr := range response.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := parseDNSCryptCert(unescapeTXT(strings.Join(txt.Txt, "")), dnscryptProviderKey)
+		if err != nil {
+			if verbose {
+				fmt.Printf("Ignoring DNSCrypt certificate: %s\n", err)
+			}
+			continue
+		}
+		if cert.valid(now) && (best == nil || cert.serial > best.serial) {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no valid DNSCrypt certificate")
+	}
+	return best, nil
+}
+
+// dnscryptCertKey identifies the certificates of a provider served by a resolver
+type dnscryptCertKey struct {
+	address  string
+	provider string
+}
+
+// dnscryptCertEntry is a certificate of the cache, or the fetch of it in progress
+type dnscryptCertEntry struct {
+	cert *dnscryptCert
+	err  error
+	// Closed once the certificate is fetched
+	fetched chan struct{}
+}
+
+// dnscryptCertCache holds the certificate of each resolver, fetched once, shared by all the
+// workers, and fetched again when it expires
+type dnscryptCertCache struct {
+	mu      sync.Mutex
+	entries map[dnscryptCertKey]*dnscryptCertEntry
+}
+
+var dnscryptCerts = &dnscryptCertCache{entries: make(map[dnscryptCertKey]*dnscryptCertEntry)}
+
+// get returns the valid certificate of the provider served at address, fetching it when
+// needed. The workers needing the certificate of a resolver wait for a single fetch, without
+// blocking the others.
+func (c *dnscryptCertCache) get(address, network string, fetch func(address, network string) (*dnscryptCert, error)) (*dnscryptCert, error) {
+	key := dnscryptCertKey{address: address, provider: dnscryptProvider}
+	c.mu.Lock()
+	entry := c.entries[key]
+	if entry != nil {
+		select {
+		case <-entry.fetched:
+			if entry.err != nil || !entry.cert.valid(time.Now()) {
+				entry = nil
+			}
+		default:
+			// Being fetched by another worker: wait for it
+		}
+	}
+	if entry == nil {
+		entry = &dnscryptCertEntry{fetched: make(chan struct{})}
+		c.entries[key] = entry
+		c.mu.Unlock()
+		entry.cert, entry.err = fetch(address, network)
+		close(entry.fetched)
+		return entry.cert, entry.err
+	}
+	c.mu.Unlock()
+	<-entry.fetched
+	return entry.cert, entry.err
+}
+
+// dnscryptSharedKey computes the key shared by the client and the resolver
+func dnscryptSharedKey(esVersion uint16, secretKey *[32]byte, publicKey *[32]byte) ([32]byte, error) {
+	var key [32]byte
+	if esVersion == dnscryptXSalsa20 {
+		box.Precompute(&key, publicKey, secretKey)
+		return key, nil
+	}
+	shared, err := curve25519.X25519(secretKey[:], publicKey[:])
+	if err != nil {
+		return key, err
+	}
+	derived, err := chacha20.HChaCha20(shared, make([]byte, 16))
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], derived)
+	return key, nil
+}
+
+// dnscryptSeal encrypts the message with the encryption system of the certificate
+func dnscryptSeal(esVersion uint16, key *[32]byte, nonce *[24]byte, message []byte) []byte {
+	if esVersion == dnscryptXSalsa20 {
+		return secretbox.Seal(nil, message, nonce, key)
+	}
+	return xsecretboxSeal(key, nonce, message)
+}
+
+// dnscryptOpen decrypts a box sealed with the encryption system of the certificate
+func dnscryptOpen(esVersion uint16, key *[32]byte, nonce *[24]byte, sealed []byte) ([]byte, error) {
+	var message []byte
+	var ok bool
+	if esVersion == dnscryptXSalsa20 {
+		message, ok = secretbox.Open(nil, sealed, nonce, key)
+	} else {
+		message, ok = xsecretboxOpen(key, nonce, sealed)
+	}
+	if !ok {
+		return nil, errors.New("unable to decrypt the DNSCrypt message")
+	}
+	return message, nil
+}
+
+// xsecretboxSeal works like secretbox.Seal, with XChaCha20 instead of XSalsa20
+func xsecretboxSeal(key *[32]byte, nonce *[24]byte, message []byte) []byte {
+	// The first block of the key stream gives the Poly1305 key, and encrypts the first 32
+	// bytes of the message
+	stream, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var firstBlock [64]byte
+	stream.XORKeyStream(firstBlock[:], firstBlock[:])
+	var polyKey [32]byte
+	copy(polyKey[:], firstBlock[:32])
+
+	sealed := make([]byte, poly1305.TagSize+len(message))
+	ciphertext := sealed[poly1305.TagSize:]
+	head := len(message)
+	if head > 32 {
+		head = 32
+	}
+	for i := 0; i < head; i++ {
+		ciphertext[i] = firstBlock[32+i] ^ message[i]
+	}
+	stream.SetCounter(1)
+	stream.XORKeyStream(ciphertext[head:], message[head:])
+
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, ciphertext, &polyKey)
+	copy(sealed, tag[:])
+	return sealed
+}
+
+// xsecretboxOpen works like secretbox.Open, with XChaCha20 instead of XSalsa20
+func xsecretboxOpen(key *[32]byte, nonce *[24]byte, sealed []byte) ([]byte, bool) {
+	if len(sealed) < poly1305.TagSize {
+		return nil, false
+	}
+	stream, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var firstBlock [64]byte
+	stream.XORKeyStream(firstBlock[:], firstBlock[:])
+	var polyKey [32]byte
+	copy(polyKey[:], firstBlock[:32])
+
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], sealed)
+	ciphertext := sealed[poly1305.TagSize:]
+	if !poly1305.Verify(&tag, ciphertext, &polyKey) {
+		return nil, false
+	}
+
+	message := make([]byte, len(ciphertext))
+	head := len(ciphertext)
+	if head > 32 {
+		head = 32
+	}
+	for i := 0; i < head; i++ {
+		message[i] = firstBlock[32+i] ^ ciphertext[i]
+	}
+	stream.SetCounter(1)
+	stream.XORKeyStream(message[head:], ciphertext[head:])
+	return message, true
+}
+
+// dnscryptPad pads the packed query (ISO/IEC 7816-4) to a multiple of the padding block, and
+// to at least minSize bytes
+func dnscryptPad(packed []byte, minSize int) []byte {
+	size := (len(packed) + 1 + dnscryptPadding - 1) / dnscryptPadding * dnscryptPadding
+	if size < minSize {
+		size = minSize
+	}
+	padded := make([]byte, size)
+	copy(padded, packed)
+	padded[len(packed)] = 0x80
+	return padded
+}
+
+// dnscryptUnpad removes the padding of a decrypted message
+func dnscryptUnpad(padded []byte) ([]byte, error) {
+	end := len(padded) - 1
+	for end >= 0 && padded[end] == 0 {
+		end--
+	}
+	if end < 0 || padded[end] != 0x80 {
+		return nil, errors.New("invalid DNSCrypt padding")
+	}
+	return padded[:end], nil
+}
+
+// dnscryptTransport sends encrypted queries to the resolver, over UDP (a new socket for each
+// query) or over a persistent TCP connection. Each transport has its own key pair, like
+// independent clients would.
+type dnscryptTransport struct {
+	address   string
+	tcp       bool
+	events    *transportEvents
+	publicKey *[32]byte
+	secretKey *[32]byte
+	cert      *dnscryptCert
+	sharedKey [32]byte
+	conn      net.Conn
+}
+
+func newDNSCryptTransport(address string, tcp bool, events *transportEvents) (*dnscryptTransport, error) {
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &dnscryptTransport{address: address, tcp: tcp, events: events, publicKey: publicKey, secretKey: secretKey}, nil
+}
+
+// certificate returns the certificate of the resolver, fetching it when the cached one expired
+func (t *dnscryptTransport) certificate() (*dnscryptCert, error) {
+	now := time.Now()
+	if t.cert != nil && t.cert.valid(now) {
+		return t.cert, nil
+	}
+
+	network := transportUDP
+	if t.tcp {
+		network = transportTCP
+	}
+	cert, err := dnscryptCerts.get(t.address, network, fetchDNSCryptCert)
+	if err != nil {
+		return nil, err
+	}
+	sharedKey, err := dnscryptSharedKey(cert.esVersion, t.secretKey, &cert.resolverKey)
+	if err != nil {
+		return nil, err
+	}
+	t.cert, t.sharedKey = cert, sharedKey
+	return cert, nil
+}
+
+// encryptQuery returns the encrypted packed query, and the client half of the nonce
+func (t *dnscryptTransport) encryptQuery(cert *dnscryptCert, packed []byte) ([]byte, []byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:12]); err != nil {
+		return nil, nil, err
+	}
+	minSize := dnscryptMinQuerySize
+	if t.tcp {
+		minSize = 0
+	}
+
+	query := append([]byte{}, cert.clientMagic[:]...)
+	query = append(query, t.publicKey[:]...)
+	query = append(query, nonce[:12]...)
+	query = append(query, dnscryptSeal(cert.esVersion, &t.sharedKey, &nonce, dnscryptPad(packed, minSize))...)
+	return query, nonce[:12], nil
+}
+
+// decryptResponse returns the packed response to the query sent with the client nonce
+func (t *dnscryptTransport) decryptResponse(cert *dnscryptCert, clientNonce []byte, response []byte) ([]byte, error) {
+	if len(response) < len(dnscryptResolverMagic)+24 || string(response[:8]) != dnscryptResolverMagic {
+		return nil, errors.New("not a DNSCrypt response")
+	}
+	var nonce [24]byte
+	copy(nonce[:], response[8:32])
+	if subtle.ConstantTimeCompare(nonce[:12], clientNonce) != 1 {
+		return nil, errors.New("unexpected DNSCrypt response nonce")
+	}
+	padded, err := dnscryptOpen(cert.esVersion, &t.sharedKey, &nonce, response[32:])
+	if err != nil {
+		return nil, err
+	}
+	return dnscryptUnpad(padded)
+}
+
+func (t *dnscryptTransport) exchange(message *dns.Msg) (*dns.Msg, error) {
+	cert, err := t.certificate()
+	if err != nil {
+		return nil, err
+	}
+	packed, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	query, clientNonce, err := t.encryptQuery(cert, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted []byte
+	if t.tcp {
+		reused := t.conn != nil
+		encrypted, err = t.sendTCP(query)
+		if ne, ok := err.(net.Error); err != nil && reused && !(ok && ne.Timeout()) {
+			// The resolver may have closed the connection while it was idle: try again on a new one
+			encrypted, err = t.sendTCP(query)
+		}
+	} else {
+		encrypted, err = t.sendUDP(query, clientNonce)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := t.decryptResponse(cert, clientNonce, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	if err = response.Unpack(decrypted); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// sendUDP sends the query from a new UDP socket, or from the socket kept while the network is
+// impaired, and reads the response to it
+func (t *dnscryptTransport) sendUDP(query []byte, clientNonce []byte) ([]byte, error) {
+	conn := t.conn
+	if conn == nil {
+		var err error
+		if conn, err = dialDatagram(t.address); err != nil {
+			return nil, err
+		}
+		if impairing() {
+			t.conn = conn
+		} else {
+			defer conn.Close()
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(exchangeTimeout))
+	if _, err := conn.Write(query); err != nil {
+		t.close()
+		return nil, err
+	}
+	buffer := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.close()
+			}
+			return nil, err
+		}
+		// Skip the late responses to the previous queries on the kept socket
+		if t.conn != nil && n >= 32 && !bytes.Equal(buffer[8:20], clientNonce) {
+			continue
+		}
+		return buffer[:n], nil
+	}
+}
+
+// sendTCP writes the length-prefixed query on the connection, opening it first if needed, and
+// reads the response
+func (t *dnscryptTransport) sendTCP(query []byte) ([]byte, error) {
+	if t.conn == nil {
+		conn, err := dialStream(t.address, t.events)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = conn
+	}
+
+	t.conn.SetDeadline(time.Now().Add(exchangeTimeout))
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := t.conn.Write(append(framed, query...)); err != nil {
+		t.close()
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(t.conn, length[:]); err != nil {
+		t.close()
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(t.conn, response); err != nil {
+		t.close()
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *dnscryptTransport) close() {
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
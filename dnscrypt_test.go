@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// testDNSCryptCert returns a certificate for the resolver key, signed with the provider key
+func testDNSCryptCert(providerKey ed25519.PrivateKey, esVersion uint16, resolverKey *[32]byte, serial uint32, notAfter time.Time) []byte {
+	signed := append([]byte{}, resolverKey[:]...)
+	signed = append(signed, []byte("magic123")...)
+	signed = binary.BigEndian.AppendUint32(signed, serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(time.Now().Add(-time.Hour).Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(notAfter.Unix()))
+
+	cert := []byte(dnscryptCertMagic)
+	cert = binary.BigEndian.AppendUint16(cert, esVersion)
+	cert = binary.BigEndian.AppendUint16(cert, 0)
+	cert = append(cert, ed25519.Sign(providerKey, signed)...)
+	return append(cert, signed...)
+}
+
+// testDNSCryptResolver decrypts a query like a DNSCrypt resolver would, and encrypts the response
+func testDNSCryptResolver(t *testing.T, esVersion uint16, secretKey *[32]byte, query []byte, response []byte) []byte {
+	if string(query[:8]) != "magic123" {
+		t.Fatalf("Invalid client magic %q", query[:8])
+	}
+	var clientKey [32]byte
+	copy(clientKey[:], query[8:40])
+	sharedKey, err := dnscryptSharedKey(esVersion, secretKey, &clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce [24]byte
+	copy(nonce[:], query[40:52])
+	padded, err := dnscryptOpen(esVersion, &sharedKey, &nonce, query[52:])
+	if err != nil {
+		t.Fatalf("Unable to decrypt the query: %s", err)
+	}
+	if len(padded) < dnscryptMinQuerySize || len(padded)%dnscryptPadding != 0 {
+		t.Errorf("Invalid padded query length %d", len(padded))
+	}
+	if packed, err := dnscryptUnpad(padded); err != nil || string(packed) != "query" {
+		t.Errorf("Invalid query: got %q (%v)", packed, err)
+	}
+
+	copy(nonce[12:], bytes.Repeat([]byte{0x42}, 12))
+	encrypted := append([]byte(dnscryptResolverMagic), nonce[:]...)
+	return append(encrypted, dnscryptSeal(esVersion, &sharedKey, &nonce, dnscryptPad(response, 0))...)
+}
+
+func TestDNSCryptRoundTrip(t *testing.T) {
+	for _, esVersion := range []uint16{dnscryptXSalsa20, dnscryptXChaCha20} {
+		resolverKey, secretKey, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &dnscryptCert{esVersion: esVersion, resolverKey: *resolverKey}
+		copy(cert.clientMagic[:], "magic123")
+
+		transport, err := newDNSCryptTransport("127.0.0.1:443", false, &transportEvents{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transport.sharedKey, err = dnscryptSharedKey(esVersion, transport.secretKey, resolverKey); err != nil {
+			t.Fatal(err)
+		}
+
+		query, clientNonce, err := transport.encryptQuery(cert, []byte("query"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted := testDNSCryptResolver(t, esVersion, secretKey, query, []byte("response"))
+
+		response, err := transport.decryptResponse(cert, clientNonce, encrypted)
+		if err != nil {
+			t.Fatalf("Unable to decrypt the response (es version %d): %s", esVersion, err)
+		}
+		if string(response) != "response" {
+			t.Errorf("Invalid response: got %q", response)
+		}
+
+		// A tampered response must be rejected
+		encrypted[len(encrypted)-1] ^= 0xff
+		if _, err = transport.decryptResponse(cert, clientNonce, encrypted); err == nil {
+			t.Error("Tampered responses should return a non-nil error")
+		}
+	}
+}
+
+func TestXSecretbox(t *testing.T) {
+	var key [32]byte
+	var nonce [24]byte
+	rand.Read(key[:])
+	rand.Read(nonce[:])
+
+	// Messages shorter and longer than the part encrypted with the first block
+	for _, size := range []int{0, 10, 32, 100} {
+		message := bytes.Repeat([]byte{'m'}, size)
+		sealed := xsecretboxSeal(&key, &nonce, message)
+		opened, ok := xsecretboxOpen(&key, &nonce, sealed)
+		if !ok || !bytes.Equal(opened, message) {
+			t.Errorf("Invalid round trip for %d bytes: got %q (%v)", size, opened, ok)
+		}
+		sealed[0] ^= 0xff
+		if _, ok = xsecretboxOpen(&key, &nonce, sealed); ok {
+			t.Errorf("Tampered box of %d bytes should not open", size)
+		}
+	}
+}
+
+func TestDNSCryptPad(t *testing.T) {
+	cases := []struct {
+		size     int
+		minSize  int
+		expected int
+	}{
+		{10, 0, 64},
+		{63, 0, 64},
+		{64, 0, 128},
+		{10, 256, 256},
+		{300, 256, 320},
+	}
+	for _, c := range cases {
+		packed := bytes.Repeat([]byte{0x80}, c.size)
+		padded := dnscryptPad(packed, c.minSize)
+		if len(padded) != c.expected {
+			t.Errorf("dnscryptPad(%d bytes, %d): got %d bytes, expected %d", c.size, c.minSize, len(padded), c.expected)
+		}
+		if unpadded, err := dnscryptUnpad(padded); err != nil || !bytes.Equal(unpadded, packed) {
+			t.Errorf("dnscryptUnpad(%d bytes): got %d bytes (%v)", len(padded), len(unpadded), err)
+		}
+	}
+	if _, err := dnscryptUnpad(make([]byte, 64)); err == nil {
+		t.Error("Messages without padding should return a non-nil error")
+	}
+}
+
+func TestParseDNSCryptCert(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolverKey := [32]byte{1, 2, 3}
+	data := testDNSCryptCert(privateKey, dnscryptXChaCha20, &resolverKey, 7, time.Now().Add(time.Hour))
+
+	cert, err := parseDNSCryptCert(data, publicKey)
+	if err != nil {
+		t.Fatalf("Unable to parse the certificate: %s", err)
+	}
+	if cert.esVersion != dnscryptXChaCha20 || cert.resolverKey != resolverKey || cert.serial != 7 ||
+		string(cert.clientMagic[:]) != "magic123" || !cert.valid(time.Now()) {
+		t.Errorf("Invalid certificate %+v", cert)
+	}
+
+	// The signature must match the provider key
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err = parseDNSCryptCert(data, otherKey); err == nil {
+		t.Error("Certificates signed by another key should return a non-nil error")
+	}
+	data[len(data)-1] ^= 0xff
+	if _, err = parseDNSCryptCert(data, publicKey); err == nil {
+		t.Error("Tampered certificates should return a non-nil error")
+	}
+}
+
+func TestUnescapeTXT(t *testing.T) {
+	cases := map[string]string{
+		`DNSC`:          "DNSC",
+		`\000\001\255`:  "\x00\x01\xff",
+		`a\"b\\c`:       `a"b\c`,
+		`\\123`:         `\123`,
+		`end\`:          `end\`,
+		`\068\078SC\;x`: "DNSC;x",
+	}
+	for input, expected := range cases {
+		if output := unescapeTXT(input); string(output) != expected {
+			t.Errorf("unescapeTXT(%q): got %q, expected %q", input, output, expected)
+		}
+	}
+}
+
+func TestParseDNSCryptStamp(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+	data := []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, field := range [][]byte{[]byte("127.0.0.1:8443"), key, []byte("2.dnscrypt-cert.example.com")} {
+		data = append(append(data, byte(len(field))), field...)
+	}
+
+	address, provider, providerKey, err := parseDNSCryptStamp(dnscryptStamp + base64.RawURLEncoding.EncodeToString(data))
+	if err != nil {
+		t.Fatalf("Unable to parse the stamp: %s", err)
+	}
+	if address != "127.0.0.1:8443" || provider != "2.dnscrypt-cert.example.com" || !bytes.Equal(providerKey, key) {
+		t.Errorf("Invalid stamp contents: %s, %s, %x", address, provider, providerKey)
+	}
+
+	// DoH stamps are not DNSCrypt ones
+	data[0] = 0x02
+	if _, _, _, err = parseDNSCryptStamp(dnscryptStamp + base64.RawURLEncoding.EncodeToString(data)); err == nil {
+		t.Error("Stamps of other protocols should return a non-nil error")
+	}
+	data[0] = 0x01
+	if _, _, _, err = parseDNSCryptStamp(dnscryptStamp + base64.RawURLEncoding.EncodeToString(data[:20])); err == nil {
+		t.Error("Truncated stamps should return a non-nil error")
+	}
+}
+
+func TestDNSCryptCertCache(t *testing.T) {
+	cache := &dnscryptCertCache{entries: make(map[dnscryptCertKey]*dnscryptCertEntry)}
+	var fetches int32
+	slow := make(chan struct{})
+	fetch := func(address, network string) (*dnscryptCert, error) {
+		atomic.AddInt32(&fetches, 1)
+		if address == "slow:443" {
+			<-slow
+		}
+		return &dnscryptCert{serial: uint32(len(address)), notAfter: time.Now().Add(time.Hour)}, nil
+	}
+
+	// The workers of a resolver wait for a single fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cert, err := cache.get("slow:443", transportUDP, fetch); err != nil || cert.serial != 8 {
+				t.Errorf("Invalid certificate of the slow resolver: %+v (%v)", cert, err)
+			}
+		}()
+	}
+	// Meanwhile, the certificate of another resolver is fetched without waiting
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if cert, err := cache.get("fast.example:443", transportTCP, fetch); err != nil || cert.serial != 16 {
+			t.Errorf("Invalid certificate of the fast resolver: %+v (%v)", cert, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The fetch of a resolver blocked the other ones")
+	}
+	close(slow)
+	wg.Wait()
+	if fetches != 2 {
+		t.Errorf("Invalid number of fetches: %d, expected 2", fetches)
+	}
+
+	// Expired certificates are fetched again
+	cache.entries[dnscryptCertKey{address: "fast.example:443"}].cert.notAfter = time.Now()
+	cache.get("fast.example:443", transportTCP, fetch)
+	if fetches != 3 {
+		t.Errorf("The expired certificate was not fetched again: %d fetches", fetches)
+	}
+}
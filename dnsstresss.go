@@ -1,16 +1,17 @@
 package main
 
 import (
-	"bufio"
 	"crypto/rand"
 	"flag"
 	"fmt"
-	"io"
 	"math/big"
-	"net"
+	mrand "math/rand"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/logrusorgru/aurora"
@@ -25,16 +26,6 @@ type query struct {
 	recordType uint16
 }
 
-// Mapping of string record types to its uint16 dns library representation
-var recordTypes = map[string]uint16{
-	"A":    dns.TypeA,
-	"AAAA": dns.TypeAAAA,
-	"ANY":  dns.TypeANY,
-	"MX":   dns.TypeMX,
-	"NS":   dns.TypeNS,
-	"TXT":  dns.TypeTXT,
-}
-
 // Runtime options
 var (
 	concurrency     int
@@ -44,6 +35,18 @@ var (
 	resolver        string
 	randomIds       bool
 	flood           bool
+	transportName   string
+	dohVersion      string
+	reconnectEvery  int
+	duration        int
+
+	// Chaos options, disrupting the connections of stream transports
+	chaosMode          string
+	chaosIntervalMs    int
+	chaosRatio         float64
+	chaosStallMs       int
+	chaosInterval      time.Duration
+	chaosStallDuration time.Duration
 
 	// Path to file with the list of DNS requests in the following format: <domain> <query-type>
 	// Example:
@@ -65,22 +68,152 @@ func init() {
 		"Use random Request Identifiers for each query")
 	flag.BoolVar(&iterative, "i", false,
 		"Do an iterative query instead of recursive (to stress authoritative nameservers)")
-	flag.StringVar(&resolver, "r", "127.0.0.1:53",
-		"Resolver to test against")
+	flag.StringVar(&resolver, "r", "127.0.0.1",
+		"Resolver to test against, or a comma-separated list of transport=resolver with a transport mix")
 	flag.BoolVar(&flood, "f", false,
 		"Don't wait for an answer before sending another")
 	flag.StringVar(&dataFile, "dataFile", "",
 		"Path to data file containing DNS requests in format '<domain name> <query type>'")
+	flag.StringVar(&configPath, "config", "",
+		"Path to a file with options, one per line as 'name = value' (the command line takes precedence)")
+	flag.Int64Var(&runSeed, "seed", 0,
+		"Seed of the random choices of the workers, e.g. the transports of a mix (0 to pick one)")
+	flag.StringVar(&generatorSource, "generator", "",
+		"Command writing the queries on its standard output, or unix:path of a socket to read them from, instead of the query list")
+	flag.StringVar(&generatorFormat, "generatorFormat", generatorLine,
+		"Format of the queries of the generator: line ('<domain name> <query type>') or binary (DNS messages prefixed with their length on 2 bytes)")
+	flag.StringVar(&scriptPath, "script", "",
+		"Path to a Starlark script defining query(worker, n) to build the queries and/or response(query, response) to check the responses")
+	flag.Float64Var(&rateLimit, "rate", 0,
+		"Maximum rate of the queries of all the workers together (in q/s, 0 for no limit)")
+	flag.Float64Var(&targetP99Ms, "targetP99", 0,
+		"Adjust the rate of the queries after each interval to hold the p99 latency at this target (in ms, 0 to disable)")
+	flag.Float64Var(&targetStep, "targetStep", 100,
+		"Increase of the rate after each interval within the p99 target, which is also the initial rate without -rate (in q/s)")
+	flag.StringVar(&webAddress, "web", "",
+		"Address on which to serve a dashboard with live charts and controls of the rate, e.g. 127.0.0.1:8080 (empty to disable)")
+	flag.StringVar(&canaryFile, "canary", "",
+		"Path to a list of queries sent at a low rate alongside the load, and reported apart from it, in the format of -dataFile")
+	flag.Float64Var(&canaryRate, "canaryRate", 1,
+		"Rate of the canary queries (in q/s)")
+	flag.IntVar(&duration, "duration", 0,
+		"Duration of the run (in s, 0 to run until interrupted)")
+	flag.StringVar(&historyPath, "history", defaultHistoryPath,
+		"Path to the database where the summary of the run is saved (empty to disable)")
+	flag.Var(&runTags, "tag", "Tag saved with the run, as key=value (repeatable)")
+	flag.StringVar(&transportName, "transport", transportUDP,
+		"Transport used to send the requests: udp, tcp, dot (DNS over TLS), doh (DNS over HTTPS), odoh (Oblivious DoH), dnscrypt or dnscrypt-tcp, or a mix of them with their weights (e.g. udp=70,tcp=10,doh=15,dot=5)")
+	flag.StringVar(&dohVersion, "dohVersion", dohHTTP2,
+		"HTTP version used by the doh and odoh transports: 1.1, 2 or 3 (QUIC)")
+	flag.StringVar(&odohRelay, "odohRelay", "",
+		"URL of the relay used by the odoh transport to reach the resolver (e.g. https://relay.example.com/proxy)")
+	flag.IntVar(&odohProbe, "odohProbe", 10,
+		"With the odoh transport, also send every Nth request directly to the resolver, to split the latency between relay and resolver (0 to disable)")
+	flag.StringVar(&dnscryptProvider, "dnscryptProvider", "",
+		"Provider name of the resolver, for the DNSCrypt transports (e.g. 2.dnscrypt-cert.example.com)")
+	flag.StringVar(&dnscryptKey, "dnscryptKey", "",
+		"Hex-encoded public key of the provider, used to verify the DNSCrypt certificates")
+	flag.BoolVar(&insecure, "insecure", false,
+		"Do not verify the certificate of the resolver (dot and doh transports)")
+	flag.StringVar(&tlsCert, "tlsCert", "",
+		"Path to the PEM client certificate, for mutual TLS")
+	flag.StringVar(&tlsKey, "tlsKey", "",
+		"Path to the PEM private key of the client certificate")
+	flag.StringVar(&tlsCA, "tlsCA", "",
+		"Path to the PEM certificates of the CAs trusted to verify the resolver (default: system roots)")
+	flag.StringVar(&tlsServerName, "tlsServerName", "",
+		"Server name sent in SNI and used to verify the certificate of the resolver (default: resolver host)")
+	flag.StringVar(&tlsMinVersion, "tlsMinVersion", "",
+		"Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&tlsMaxVersion, "tlsMaxVersion", "",
+		"Maximum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&tlsCiphers, "tlsCiphers", "",
+		"Comma-separated list of TLS 1.0-1.2 cipher suites (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)")
+	flag.StringVar(&tlsCurves, "tlsCurves", "",
+		"Comma-separated list of key exchange groups: X25519, P256, P384, P521, X25519MLKEM768")
+	flag.StringVar(&tlsALPN, "tlsALPN", "",
+		"Comma-separated list of ALPN protocols to offer (default: none for dot, h2 and http/1.1 for doh)")
+	flag.BoolVar(&tlsNoResumption, "tlsNoResumption", false,
+		"Disable TLS session resumption")
+	flag.IntVar(&reconnectEvery, "reconnect", 0,
+		"Open a new connection every N requests, to stress handshakes (stream transports, 0 to keep connections open)")
+	flag.IntVar(&holdTarget, "hold", 0,
+		"Hold N mostly idle connections open to the resolver while the workers measure the latency (stream transports)")
+	flag.IntVar(&holdRate, "holdRate", 100,
+		"Number of held connections opened per second")
+	flag.IntVar(&holdKeepaliveMs, "holdKeepalive", 10000,
+		"Interval between two queries on each held connection, to keep it open (in ms, 0 to keep them idle)")
+	flag.Float64Var(&holdDegradation, "holdDegradation", 2,
+		"Factor of the initial mean latency from which the latency is reported as degraded")
+	flag.StringVar(&authAddress, "auth", "",
+		"Address on which the built-in authoritative server answers for the test zone, e.g. 127.0.0.1:5301 (empty to disable)")
+	flag.StringVar(&authZoneName, "authZone", "stress.test.",
+		"Name of the DNSSEC-signed test zone served by the built-in authoritative server")
+	flag.IntVar(&authNames, "authNames", 1000,
+		"Number of names in the test zone")
+	flag.StringVar(&authKeyFile, "authKey", "",
+		"Path to the key signing the test zone, generated when missing (empty to use a new key on each run)")
+	flag.IntVar(&authTTL, "authTTL", 300,
+		"TTL of the records of the test zone (in s)")
+	flag.StringVar(&outageMode, "authOutage", "",
+		"Make the built-in authoritative server fail during the run: silent, slow or servfail")
+	flag.IntVar(&outageStartMs, "authOutageStart", 10000,
+		"Time from the start of the run to the outage of the authoritative server (in ms)")
+	flag.IntVar(&outageLengthMs, "authOutageLength", 10000,
+		"Length of the outage of the authoritative server (in ms)")
+	flag.IntVar(&outageDelayMs, "authOutageDelay", 3000,
+		"Delay of the answers of the authoritative server during a slow outage (in ms)")
+	flag.StringVar(&nxdomainZone, "nxdomain", "",
+		"Query random non-existent names under the zone, e.g. to measure aggressive NSEC caching (RFC 8198)")
+	flag.Float64Var(&downtimeRate, "downtimeRate", 0.1,
+		"Share of the usual reply rate below which an interval is reported as an outage")
+	flag.Float64Var(&downtimeErrors, "downtimeErrors", 0.5,
+		"Share of errors above which an interval is reported as an outage")
+	flag.IntVar(&herdSize, "herd", 0,
+		"Send the first query from N clients at the same instant, round after round, to test request coalescing (0 to disable)")
+	flag.IntVar(&herdIntervalMs, "herdInterval", 0,
+		"Interval between two rounds of the herd (in ms, 0 to start each round right after the TTL of the answer expired)")
+	flag.Float64Var(&impairLoss, "impairLoss", 0,
+		"Share of the packets to and from the resolver lost by the client (between 0 and 1), like on a lossy network")
+	flag.IntVar(&impairLatencyMs, "impairLatency", 0,
+		"Delay added by the client to the packets to and from the resolver (in ms)")
+	flag.IntVar(&impairJitterMs, "impairJitter", 0,
+		"Maximum random variation of the delay of the packets, above or below -impairLatency (in ms)")
+	flag.Float64Var(&impairReorder, "impairReorder", 0,
+		"Share of the packets held back for twice their delay, so that the next UDP packets overtake them (between 0 and 1)")
+	flag.StringVar(&chaosMode, "chaos", "",
+		"Periodically disrupt the connections of stream transports: reset, halfclose or stall")
+	flag.IntVar(&chaosIntervalMs, "chaosInterval", 5000,
+		"Interval between two disruptions of the connections (in ms)")
+	flag.Float64Var(&chaosRatio, "chaosRatio", 1,
+		"Share of the open connections disrupted each time (between 0 and 1)")
+	flag.IntVar(&chaosStallMs, "chaosStall", 500,
+		"Time during which a stalled read is paused (in ms)")
 }
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "history":
+			os.Exit(historyCommand(os.Args[2:]))
+		case "corpus":
+			os.Exit(corpusCommand(os.Args[2:]))
+		}
+	}
+
 	fmt.Printf("dnsstresss - dns stress tool\n\n")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, strings.Join([]string{
+		fmt.Fprint(os.Stderr, strings.Join([]string{
 			"Send DNS requests as fast as possible to a given server and display the rate.",
 			"",
 			"Usage: dnsstresss [option ...] targetdomain [targetdomain [...] ]",
+			"       dnsstresss -nxdomain zone [option ...]",
+			"       dnsstresss -generator command [option ...]",
+			"       dnsstresss -script file.star [option ...]",
+			"       dnsstresss history [option ...]",
+			"       dnsstresss corpus action [option ...] [file ...]",
 			"",
 		}, "\n"))
 		flag.PrintDefaults()
@@ -88,12 +221,102 @@ func main() {
 
 	flag.Parse()
 
-	parsedResolver, err := ParseIPPort(resolver)
+	var err error
+	if configPath != "" {
+		if err = loadConfig(configPath); err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to load the configuration file", err))
+			os.Exit(2)
+		}
+	}
+	if runSeed == 0 {
+		runSeed = time.Now().UnixNano()
+	}
+
+	err = loadTransportMix()
 	if err != nil {
-		fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to parse the resolver address", err))
+		fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Invalid transport or resolver", err))
 		os.Exit(2)
 	}
-	resolver = parsedResolver
+
+	if chaosMode != "" {
+		if !chaosModes[chaosMode] {
+			fmt.Println(aurora.Sprintf(aurora.Red("Unknown chaos mode %q"), chaosMode))
+			os.Exit(2)
+		}
+		if !mixHas(func(name string) bool {
+			return isStreamTransport(name) && !(isHTTPTransport(name) && dohVersion == dohHTTP3)
+		}) {
+			fmt.Println(aurora.Red("Chaos options are only available with the tcp, dot, doh, odoh (HTTP/1.1 and HTTP/2) and dnscrypt-tcp transports"))
+			os.Exit(2)
+		}
+		chaosInterval = time.Duration(chaosIntervalMs) * time.Millisecond
+		chaosStallDuration = time.Duration(chaosStallMs) * time.Millisecond
+	}
+	if impairLoss != 0 || impairLatencyMs != 0 || impairJitterMs != 0 || impairReorder != 0 {
+		if impairLoss < 0 || impairLoss >= 1 || impairReorder < 0 || impairReorder > 1 || impairLatencyMs < 0 || impairJitterMs < 0 {
+			fmt.Println(aurora.Red("Invalid network impairment: the loss must be between 0 and 1 (excluded), the reordering between 0 and 1, and the delays positive"))
+			os.Exit(2)
+		}
+		if impairReorder > 0 && impairLatencyMs == 0 && impairJitterMs == 0 {
+			fmt.Println(aurora.Red("Reordering the packets needs a delay (-impairLatency or -impairJitter)"))
+			os.Exit(2)
+		}
+		if mixHas(func(name string) bool { return isHTTPTransport(name) && dohVersion == dohHTTP3 }) {
+			fmt.Println(aurora.Red("Network impairment is not available with HTTP/3"))
+			os.Exit(2)
+		}
+		impairLatency = time.Duration(impairLatencyMs) * time.Millisecond
+		impairJitter = time.Duration(impairJitterMs) * time.Millisecond
+	}
+	if err = loadTLSConfig(); err != nil {
+		fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Invalid TLS options", err))
+		os.Exit(2)
+	}
+	if reconnectEvery > 0 && !mixHas(isStreamTransport) {
+		fmt.Println(aurora.Red("The reconnect option is only available with the tcp, dot, doh, odoh and dnscrypt-tcp transports"))
+		os.Exit(2)
+	}
+	if holdTarget > 0 {
+		if len(transportMix) > 1 || !isStreamTransport(transportMix[0].name) {
+			fmt.Println(aurora.Red("The hold option is only available with a single tcp, dot, doh, odoh or dnscrypt-tcp transport"))
+			os.Exit(2)
+		}
+		if holdRate <= 0 {
+			fmt.Println(aurora.Red("The rate of held connections must be positive"))
+			os.Exit(2)
+		}
+		holdKeepalive = time.Duration(holdKeepaliveMs) * time.Millisecond
+	}
+	if flood && (len(transportMix) > 1 || transportMix[0].name != transportUDP) {
+		fmt.Println(aurora.Red("Flooding mode is only available with the udp transport"))
+		os.Exit(2)
+	}
+
+	if outageMode != "" {
+		if !outageModes[outageMode] {
+			fmt.Println(aurora.Sprintf(aurora.Red("Unknown outage mode %q"), outageMode))
+			os.Exit(2)
+		}
+		if authAddress == "" {
+			fmt.Println(aurora.Red("Outages are only available with the built-in authoritative server (-auth)"))
+			os.Exit(2)
+		}
+		if authTTL*1000 >= outageLengthMs {
+			fmt.Println(aurora.Red("The outage must last longer than the TTL of the test zone (-authTTL), or no answer can be stale"))
+			os.Exit(2)
+		}
+	}
+	if authAddress != "" {
+		if authoritative, err = startAuthServer(); err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to start the authoritative server", err))
+			os.Exit(2)
+		}
+		fmt.Printf("Authoritative server answering for %s on %s, with trust anchor:\n", authoritative.origin, authAddress)
+		fmt.Println(aurora.Faint(authoritative.key.ToDS(dns.SHA256).String()))
+	}
+	if nxdomainZone != "" {
+		nxdomainZone = dns.Fqdn(nxdomainZone)
+	}
 
 	var queries []query
 	if dataFile != "" {
@@ -103,34 +326,48 @@ func main() {
 			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to open dataFile", err))
 			os.Exit(2)
 		}
-		defer f.Close()
-
-		r := bufio.NewReader(f)
-		for {
-			var str string
-			str, err = r.ReadString('\n')
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to read dataFile", err))
-				os.Exit(2)
-			}
-
-			spl := strings.Fields(str)
-			queries = append(queries, query{
-				domain:     spl[0],
-				recordType: recordTypes[spl[1]],
-			})
+		queries, err = readQueries(f)
+		f.Close()
+		if err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to read dataFile", err))
+			os.Exit(2)
 		}
 	}
 
 	// all remaining parameters are treated as domains to be used in round-robin in the threads
 	if len(queries) == 0 {
-		for index, element := range flag.Args() {
-			queries[index] = query{
-				domain:     element,
+		for _, element := range flag.Args() {
+			queries = append(queries, query{
+				domain:     dns.Fqdn(element),
 				recordType: dns.TypeA,
-			}
+			})
+		}
+	}
+
+	// The nxdomain workload only needs the types of the queries
+	if len(queries) == 0 && nxdomainZone != "" {
+		queries = append(queries, query{domain: nxdomainZone, recordType: dns.TypeA})
+	}
+
+	if generatorSource != "" {
+		if generatedQueries, err = startGenerator(generatorSource, generatorFormat); err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to start the query generator", err))
+			os.Exit(2)
+		}
+		// The workers send the queries of the generator instead
+		if len(queries) == 0 {
+			queries = append(queries, query{domain: ".", recordType: dns.TypeA})
+		}
+	}
+
+	if scriptPath != "" {
+		if script, err = loadScript(scriptPath); err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to load the script", err))
+			os.Exit(2)
+		}
+		// The workers send the queries of the script instead
+		if len(queries) == 0 && script.query != nil {
+			queries = append(queries, query{domain: ".", recordType: dns.TypeA})
 		}
 	}
 
@@ -140,15 +377,78 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Create a channel for communicating the number of sent messages
+	metadata = newRunMetadata()
+	printMetadata(metadata)
+
+	if targetP99Ms > 0 {
+		if targetStep <= 0 {
+			fmt.Println(aurora.Red("The step of the adaptive rate must be positive"))
+			os.Exit(2)
+		}
+		adaptive = newAdaptiveController(time.Duration(targetP99Ms*float64(time.Millisecond)), targetStep)
+		if rateLimit == 0 {
+			rateLimit = targetStep
+		}
+	}
+	pacing.setRate(rateLimit)
+	pacing.take()
+	if webAddress != "" {
+		if web, err = startDashboard(webAddress); err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to start the dashboard", err))
+			os.Exit(2)
+		}
+		fmt.Print(aurora.Faint(fmt.Sprintf("Dashboard on http://%s/\n", webAddress)))
+	}
+
+	// Create a channel for the events of the other routines, the workers keep their stats in
+	// their own shard
 	sentCounterCh := make(chan statsMessage, concurrency)
+	shards := newStatsShards(concurrency, len(transportMix), time.Duration(displayInterval)*time.Millisecond)
+
+	if herdSize > 0 {
+		go runHerd(new(dns.Msg).SetQuestion(queries[0].domain, queries[0].recordType), sentCounterCh)
+		// Keep the name of the herd out of the cache between two rounds
+		if len(queries) > 1 {
+			queries = queries[1:]
+		}
+	}
+	if canaryFile != "" {
+		canaryQueries, err := loadCanary(canaryFile)
+		if err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to read the canary queries", err))
+			os.Exit(2)
+		}
+		go runCanary(canaryQueries, sentCounterCh)
+	}
+	if holdTarget > 0 {
+		go runHold(new(dns.Msg).SetQuestion(queries[0].domain, queries[0].recordType), sentCounterCh)
+	}
 
 	// Run concurrently
+	// Each thread gets its own share of the queries, or all of them when there are fewer
+	// queries than threads
 	step := len(queries) / concurrency
+	var workers sync.WaitGroup
 	for threadID := 0; threadID < concurrency; threadID++ {
-		go linearResolver(threadID, queries[:step], sentCounterCh)
-		queries = queries[step:]
+		share := queries
+		if step > 0 {
+			share = queries[threadID*step : (threadID+1)*step]
+			if threadID == concurrency-1 {
+				share = queries[threadID*step:]
+			}
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			linearResolver(threadID, share, shards.shards[threadID])
+		}()
 	}
+	// The workers only stop once the query generator is exhausted
+	finished := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(finished)
+	}()
 	fmt.Print(aurora.Faint(fmt.Sprintf("Started %d threads.\n", runtime.NumCPU())))
 
 	if !flood {
@@ -156,85 +456,253 @@ func main() {
 	} else {
 		fmt.Println("Flooding mode, nothing will be printed.")
 	}
+	if chaosMode != "" {
+		go runChaos(sentCounterCh)
+	}
+	go stopRun(sentCounterCh, finished)
+
 	// We still need this useless routine to empty the channels, even when flooding
-	displayStats(sentCounterCh)
+	summary := displayStats(sentCounterCh, shards)
+	printSummary(summary)
+	if historyPath != "" {
+		record := newRunRecord(metadata, summary)
+		if err = saveRun(historyPath, record); err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to save the run in the history", err))
+			os.Exit(2)
+		}
+		fmt.Print(aurora.Faint(fmt.Sprintf("Run #%d saved in the history.\n", record.ID)))
+	}
 }
 
-func linearResolver(threadID int, queries []query, sentCounterCh chan<- statsMessage) {
+// stopRun stops the run once its duration is over, when the workers are finished, or when
+// interrupted
+func stopRun(channel chan<- statsMessage, finished <-chan struct{}) {
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	var over <-chan time.Time
+	if duration > 0 {
+		over = time.After(time.Duration(duration) * time.Second)
+	}
+	select {
+	case <-interrupted:
+	case <-over:
+	case <-finished:
+	}
+	channel <- statsMessage{stop: true}
+}
+
+func linearResolver(threadID int, queries []query, shard *statsShard) {
 	// Resolve the domain as fast as possible
 	if verbose {
 		fmt.Printf("Starting thread #%d.\n", threadID)
 	}
 
-	// Every N steps, we will tell the stats module how many requests we sent
+	// One transport of each kind of the mix, opened on first use
+	events := &transportEvents{}
+	transports := make([]transport, len(transportMix))
+	exchanges := make([]int, len(transportMix))
+	defer func() {
+		for _, t := range transports {
+			if t != nil {
+				t.close()
+			}
+		}
+	}()
+	random := mrand.New(mrand.NewSource(runSeed + int64(threadID)))
+
+	// Each query is sent N times in a row
 	displayStep := 5
 	maxRequestID := big.NewInt(65536)
-	errors := 0
 
-	var start time.Time
-	var elapsed time.Duration    // Total time spent resolving
-	var maxElapsed time.Duration // Maximum time took by a request
+	var outage *outageSchedule
+	if authoritative != nil {
+		outage = authoritative.outage
+	}
+	var runner *scriptRunner
+	if script != nil {
+		runner = newScriptRunner(script, threadID)
+	}
 
 	for {
 		for _, q := range queries {
-			message := new(dns.Msg).SetQuestion(q.domain, q.recordType)
+			base := new(dns.Msg).SetQuestion(q.domain, q.recordType)
 			if iterative {
-				message.RecursionDesired = false
+				base.RecursionDesired = false
 			}
 
 			for i := 0; i < displayStep; i++ {
+				pacing.wait()
+				message := base
+				if generatedQueries != nil {
+					generated, ok := <-generatedQueries
+					if !ok {
+						return
+					}
+					message = generated
+				}
+				if runner != nil {
+					scripted, err := runner.query()
+					if err != nil {
+						fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "The query function of the script failed", err))
+						os.Exit(2)
+					}
+					if scripted != nil {
+						message = scripted
+					}
+				}
+
+				if message == base && (randomIds || nxdomainZone != "") {
+					// The message is changed below, while the previous one may still be packed
+					// by its exchange in flooding mode
+					message = base.Copy()
+				}
+
 				// Try to resolve the domain
 				if randomIds {
 					// Regenerate message Id to avoid servers dropping (seemingly) duplicate messages
 					newid, _ := rand.Int(rand.Reader, maxRequestID)
 					message.Id = uint16(newid.Int64())
 				}
+				if nxdomainZone != "" {
+					message.Question[0].Name = randomLabel(random) + "." + nxdomainZone
+				}
+
+				index := pickTransport(random)
+				if transports[index] == nil {
+					t, err := newTransport(transportMix[index].name, transportMix[index].address, events)
+					if err != nil {
+						fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to create the transport", err))
+						os.Exit(2)
+					}
+					transports[index] = t
+				}
+				t := transports[index]
+				var pattern *amplificationKey
+				if authoritative != nil {
+					key := authoritative.amplification.key(message.Question[0].Qtype, message.Question[0].Name)
+					pattern = &key
+				}
 
 				if flood {
-					go dnsExchange(resolver, message)
-				} else {
-					start = time.Now()
-					err := dnsExchange(resolver, message)
-					spent := time.Since(start)
-					elapsed += spent
-					if spent > maxElapsed {
-						maxElapsed = spent
+					go t.exchange(message)
+					stats := shard.begin(time.Now())
+					stats.sent++
+					if pattern != nil {
+						stats.amplified(*pattern)
 					}
-					if err != nil {
+					if runner != nil {
+						stats.count(runner.take())
+					}
+					shard.end()
+					continue
+				}
+
+				if reconnectEvery > 0 && exchanges[index] > 0 && exchanges[index]%reconnectEvery == 0 {
+					// Drop the connection, the next exchange opens a new one
+					t.close()
+				}
+				exchanges[index]++
+
+				start := time.Now()
+				response, err := t.exchange(message)
+				if err != nil && events.disruptions.pending() {
+					// The connection was disrupted under our feet: try again on a new one
+					response, err = t.exchange(message)
+				}
+				completed := time.Now()
+				spent := completed.Sub(start)
+				failed := err != nil || response.Rcode == dns.RcodeServerFailure
+				if err != nil && verbose {
+					fmt.Printf("%s error: %s (%s %s)\n", message.Question[0].Name, err, transportMix[index].name, transportMix[index].address)
+				}
+				rejected := false
+				if runner != nil {
+					valid, scriptErr := runner.response(message, response, err, spent)
+					if scriptErr != nil {
+						fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "The response function of the script failed", scriptErr))
+						os.Exit(2)
+					}
+					if !valid && !failed {
 						if verbose {
-							fmt.Printf("%s error: %d (%s)\n", q.domain, err, resolver)
+							fmt.Printf("%s error: rejected by the script (%s %s)\n", message.Question[0].Name, transportMix[index].name, transportMix[index].address)
 						}
-						errors++
+						rejected = true
+						failed = true
 					}
 				}
-			}
+				stale := false
+				var lastFailure time.Time
+				if outage != nil {
+					now := time.Now()
+					// Answered while the upstream was failing, and the records cached before
+					// expired
+					stale = outage.stale(now) && !failed && len(response.Answer) > 0
+					if failed && !now.Before(outage.start) {
+						lastFailure = now
+					}
+				}
+				var recovery time.Duration
+				disrupted := events.disruptions.take()
+				if !disrupted.IsZero() {
+					recovery = time.Since(disrupted)
+				}
+				fullHandshakes, resumedHandshakes, handshakeTime, maxHandshakeTime := events.handshakes.take()
+				odohSamples, odohViaRelay, odohDirect := events.odoh.take()
+				var counters map[string]int
+				if runner != nil {
+					counters = runner.take()
+				}
 
-			// Update the counter of sent requests and requests
-			sentCounterCh <- statsMessage{
-				sent:       displayStep,
-				err:        errors,
-				elapsed:    elapsed,
-				maxElapsed: maxElapsed,
+				// Update the stats of the worker, taken by the stats module at the end of the
+				// interval in which the query completed
+				stats := shard.begin(completed)
+				stats.sent++
+				stats.elapsed += spent
+				if spent > stats.maxElapsed {
+					stats.maxElapsed = spent
+				}
+				stats.latencies.record(spent)
+				if err != nil || rejected {
+					stats.err++
+				}
+				if err == nil && response.Rcode == dns.RcodeNameError {
+					stats.nxdomain++
+				} else if err == nil && response.Rcode == dns.RcodeServerFailure {
+					stats.servfail++
+				}
+				if stale {
+					stats.stale++
+				}
+				if lastFailure.After(stats.lastFailure) {
+					stats.lastFailure = lastFailure
+				}
+				if stats.transports != nil {
+					stats.transports[index].record(spent, err != nil)
+				}
+				if !disrupted.IsZero() && err != nil {
+					stats.lost++
+				} else if !disrupted.IsZero() {
+					stats.recovered++
+					stats.recoveryTime += recovery
+					if recovery > stats.maxRecoveryTime {
+						stats.maxRecoveryTime = recovery
+					}
+				}
+				stats.handshakes += fullHandshakes
+				stats.resumed += resumedHandshakes
+				stats.handshakeTime += handshakeTime
+				if maxHandshakeTime > stats.maxHandshakeTime {
+					stats.maxHandshakeTime = maxHandshakeTime
+				}
+				stats.odohSamples += odohSamples
+				stats.odohViaRelay += odohViaRelay
+				stats.odohDirect += odohDirect
+				stats.count(counters)
+				if pattern != nil {
+					stats.amplified(*pattern)
+				}
+				shard.end()
 			}
-			errors = 0
-			elapsed = 0
-			maxElapsed = 0
 		}
 	}
 }
-
-func dnsExchange(resolver string, message *dns.Msg) error {
-	//XXX: How can we share the connection between subsequent attempts ?
-	dnsconn, err := net.Dial("udp", resolver)
-	if err != nil {
-		return err
-	}
-	co := &dns.Conn{Conn: dnsconn}
-	defer co.Close()
-
-	// Actually send the message and wait for answer
-	co.WriteMsg(message)
-
-	_, err = co.ReadMsg()
-	return err
-}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+)
+
+// Outage detection options
+var (
+	// Share of the usual reply rate below which an interval is counted as an outage
+	downtimeRate float64
+	// Share of errors above which an interval is counted as an outage
+	downtimeErrors float64
+)
+
+// Share of the usual reply rate from which the resolver is considered recovered
+const downtimeRecoveredRate = 0.9
+
+// Weight of the last healthy interval in the usual reply rate
+const downtimeBaselineWeight = 0.2
+
+// Number of intervals in a row with replies after which the resolver is considered recovered,
+// at its new usual reply rate, even when it does not get back to the former one
+const downtimeSettledIntervals = 10
+
+// downtimePeriod is an outage detected during the run
+type downtimePeriod struct {
+	// Start of the first interval of the outage
+	Start time.Time `json:"start"`
+	// Start of the first interval with replies again
+	End time.Time `json:"end"`
+	// Start of the first interval with the usual reply rate again, or of the intervals in a row
+	// with replies after which a lower rate became the usual one, or the zero time if the
+	// resolver did not recover before the end of the run
+	Recovered time.Time `json:"recovered"`
+}
+
+// downtimeSummary sums up the outages detected during the run
+type downtimeSummary struct {
+	Outages  []downtimePeriod `json:"outages"`
+	Downtime time.Duration    `json:"downtime"`
+	// Time from the start of the outages to the recovery of the usual reply rate
+	MeanRecovery time.Duration `json:"mean_recovery"`
+	MaxRecovery  time.Duration `json:"max_recovery"`
+}
+
+// downtimeDetector follows the reply rate and the errors of the intervals, to detect when the
+// resolver stops answering and when it recovers
+type downtimeDetector struct {
+	// Usual reply rate of the healthy intervals
+	baseline float64
+	// Outage in progress, until the resolver recovers
+	current *downtimePeriod
+	outages []downtimePeriod
+	// Intervals in a row with replies during the outage in progress, and their reply rate
+	healthy     int
+	healthyRate float64
+	healthyFrom time.Time
+}
+
+// check updates the detector with an interval of the stats, and prints a notice when an
+// outage starts, ends, or when the resolver recovers
+func (d *downtimeDetector) check(start, end time.Time, sent, errors int) {
+	rate := float64(sent-errors) / end.Sub(start).Seconds()
+	down := d.baseline > 0 && (rate < downtimeRate*d.baseline ||
+		(sent > 0 && float64(errors)/float64(sent) > downtimeErrors))
+
+	switch {
+	case d.current == nil && down:
+		d.current = &downtimePeriod{Start: start}
+		fmt.Println(aurora.Red(fmt.Sprintf("Outage detected (%.0f%% of the usual reply rate)", 100*rate/d.baseline)))
+	case d.current == nil:
+		if d.baseline == 0 {
+			d.baseline = rate
+		} else {
+			d.baseline = (1-downtimeBaselineWeight)*d.baseline + downtimeBaselineWeight*rate
+		}
+	case down:
+		// Still down, or down again before recovering
+		d.current.End = time.Time{}
+		d.healthy, d.healthyRate = 0, 0
+	default:
+		if d.current.End.IsZero() {
+			d.current.End = start
+			fmt.Println(aurora.Yellow(fmt.Sprintf("Outage over after %s", d.current.End.Sub(d.current.Start).Round(time.Millisecond))))
+		}
+		if d.healthy == 0 {
+			d.healthyFrom = start
+		}
+		d.healthy++
+		d.healthyRate += rate
+		if rate >= downtimeRecoveredRate*d.baseline {
+			d.recover(start)
+			fmt.Println(aurora.Yellow(fmt.Sprintf("Recovered %s after the start of the outage", start.Sub(d.outages[len(d.outages)-1].Start).Round(time.Millisecond))))
+		} else if d.healthy >= downtimeSettledIntervals {
+			// The resolver settled at a lower reply rate, which is the usual one from now on
+			baseline := d.healthyRate / float64(d.healthy)
+			fmt.Println(aurora.Yellow(fmt.Sprintf("Settled at %.0f%% of the former reply rate", 100*baseline/d.baseline)))
+			d.baseline = baseline
+			d.recover(d.healthyFrom)
+		}
+	}
+}
+
+// recover ends the outage in progress, with the resolver recovered at the given time
+func (d *downtimeDetector) recover(at time.Time) {
+	d.current.Recovered = at
+	d.outages = append(d.outages, *d.current)
+	d.current = nil
+	d.healthy, d.healthyRate = 0, 0
+}
+
+// rebase forgets the usual reply rate, e.g. when the rate of the queries changed, unless an
+// outage is in progress
+func (d *downtimeDetector) rebase() {
+	if d.current == nil {
+		d.baseline = 0
+	}
+}
+
+// summary returns the outages detected until the end of the run
+func (d *downtimeDetector) summary(end time.Time) *downtimeSummary {
+	outages := d.outages
+	if d.current != nil {
+		current := *d.current
+		if current.End.IsZero() {
+			current.End = end
+		}
+		outages = append(outages, current)
+	}
+	if len(outages) == 0 {
+		return nil
+	}
+
+	s := &downtimeSummary{Outages: outages}
+	recovered := 0
+	var recovery time.Duration
+	for _, outage := range outages {
+		s.Downtime += outage.End.Sub(outage.Start)
+		if outage.Recovered.IsZero() {
+			continue
+		}
+		recovered++
+		took := outage.Recovered.Sub(outage.Start)
+		recovery += took
+		if took > s.MaxRecovery {
+			s.MaxRecovery = took
+		}
+	}
+	if recovered > 0 {
+		s.MeanRecovery = recovery / time.Duration(recovered)
+	}
+	return s
+}
+
+// printDowntimeSummary prints the outages detected during the run
+func printDowntimeSummary(s *downtimeSummary) {
+	fmt.Printf(
+		"  %s %d, %s of downtime",
+		aurora.Red("Outages:"),
+		len(s.Outages),
+		s.Downtime.Round(time.Millisecond),
+	)
+	if s.MaxRecovery > 0 {
+		fmt.Printf(
+			" (time to recover: mean=%s / max=%s)",
+			s.MeanRecovery.Round(time.Millisecond),
+			s.MaxRecovery.Round(time.Millisecond),
+		)
+	}
+	if s.Outages[len(s.Outages)-1].Recovered.IsZero() {
+		fmt.Print(", not recovered at the end of the run")
+	}
+	fmt.Print("\n")
+	for _, outage := range s.Outages {
+		fmt.Printf("    %s - %s", outage.Start.Format("15:04:05.000"), outage.End.Format("15:04:05.000"))
+		if !outage.Recovered.IsZero() {
+			fmt.Printf(", recovered at %s", outage.Recovered.Format("15:04:05.000"))
+		}
+		fmt.Print("\n")
+	}
+}
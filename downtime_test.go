@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDowntimeDetector(t *testing.T) {
+	downtimeRate, downtimeErrors = 0.1, 0.5
+	var detector downtimeDetector
+	start := time.Unix(1000, 0)
+	// Replies and errors of each interval of one second
+	intervals := [][2]int{
+		{1000, 0}, {1000, 0}, {0, 0}, {50, 0}, {500, 0}, {1000, 0}, {1000, 0},
+		{1000, 900}, {950, 0}, {0, 0},
+	}
+	for i, interval := range intervals {
+		from := start.Add(time.Duration(i) * time.Second)
+		detector.check(from, from.Add(time.Second), interval[0], interval[1])
+	}
+	summary := detector.summary(start.Add(time.Duration(len(intervals)) * time.Second))
+	if summary == nil || len(summary.Outages) != 3 {
+		t.Fatalf("Invalid outages: %+v", summary)
+	}
+
+	expected := []downtimePeriod{
+		{Start: start.Add(2 * time.Second), End: start.Add(4 * time.Second), Recovered: start.Add(5 * time.Second)},
+		{Start: start.Add(7 * time.Second), End: start.Add(8 * time.Second), Recovered: start.Add(8 * time.Second)},
+		{Start: start.Add(9 * time.Second), End: start.Add(10 * time.Second)},
+	}
+	for i, outage := range summary.Outages {
+		if outage != expected[i] {
+			t.Errorf("Invalid outage %d: got %+v, expected %+v", i, outage, expected[i])
+		}
+	}
+	if summary.Downtime != 4*time.Second || summary.MaxRecovery != 3*time.Second || summary.MeanRecovery != 2*time.Second {
+		t.Errorf("Invalid summary: %+v", summary)
+	}
+}
+
+func TestDowntimeRebase(t *testing.T) {
+	downtimeRate, downtimeErrors = 0.1, 0.5
+	var detector downtimeDetector
+	start := time.Unix(1000, 0)
+	detector.check(start, start.Add(time.Second), 1000, 0)
+	// The rate of the queries was lowered to 50q/s
+	detector.rebase()
+	for i := 1; i < 5; i++ {
+		from := start.Add(time.Duration(i) * time.Second)
+		detector.check(from, from.Add(time.Second), 50, 0)
+	}
+	if summary := detector.summary(start.Add(5 * time.Second)); summary != nil {
+		t.Errorf("A lower rate of queries should not be an outage: %+v", summary)
+	}
+}
+
+func TestDowntimeSettled(t *testing.T) {
+	downtimeRate, downtimeErrors = 0.1, 0.5
+	var detector downtimeDetector
+	start := time.Unix(1000, 0)
+	check := func(i int, replies int) {
+		from := start.Add(time.Duration(i) * time.Second)
+		detector.check(from, from.Add(time.Second), replies, 0)
+	}
+	check(0, 1000)
+	check(1, 0)
+	// Restarted, with 80% of its former reply rate
+	for i := 2; i < 2+downtimeSettledIntervals; i++ {
+		check(i, 800)
+	}
+	// Another outage is detected against the new reply rate, and recovered from separately
+	check(20, 0)
+	check(21, 800)
+
+	summary := detector.summary(start.Add(22 * time.Second))
+	expected := []downtimePeriod{
+		{Start: start.Add(time.Second), End: start.Add(2 * time.Second), Recovered: start.Add(2 * time.Second)},
+		{Start: start.Add(20 * time.Second), End: start.Add(21 * time.Second), Recovered: start.Add(21 * time.Second)},
+	}
+	if summary == nil || len(summary.Outages) != len(expected) {
+		t.Fatalf("Invalid outages: %+v", summary)
+	}
+	for i, outage := range summary.Outages {
+		if outage != expected[i] {
+			t.Errorf("Invalid outage %d: got %+v, expected %+v", i, outage, expected[i])
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/miekg/dns"
+)
+
+// External query generator options
+var (
+	// Command writing the queries on its standard output, or unix:path of a socket to read
+	// them from
+	generatorSource string
+	// Format of the queries: generatorLine or generatorBinary
+	generatorFormat string
+)
+
+// Formats of the queries written by external generators
+const (
+	// generatorLine is a domain name and a query type per line, like -dataFile
+	generatorLine = "line"
+	// generatorBinary is a DNS message in wire format per query, prefixed with its length on
+	// two bytes in network order, like over TCP
+	generatorBinary = "binary"
+)
+
+// Prefix of the generator sources that are Unix sockets
+const generatorSocketPrefix = "unix:"
+
+// generatedQueries receives the queries of the external generator, when there is one
+var generatedQueries <-chan *dns.Msg
+
+// startGenerator connects to the external generator, and returns the channel on which its
+// queries are sent until it is exhausted. The channel is small, so that the reads stop when
+// the workers are busy, and the generator blocks on its writes.
+func startGenerator(source, format string) (<-chan *dns.Msg, error) {
+	var read func(io.Reader, chan<- *dns.Msg) error
+	switch format {
+	case generatorLine:
+		read = readGeneratedLines
+	case generatorBinary:
+		read = readGeneratedMessages
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	var r io.ReadCloser
+	var wait func() error
+	if path, ok := strings.CutPrefix(source, generatorSocketPrefix); ok {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		r, wait = conn, func() error { return nil }
+	} else {
+		command := exec.Command("sh", "-c", source)
+		command.Stderr = os.Stderr
+		stdout, err := command.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = command.Start(); err != nil {
+			return nil, err
+		}
+		r, wait = stdout, command.Wait
+	}
+
+	queries := make(chan *dns.Msg, concurrency)
+	go func() {
+		defer close(queries)
+		err := read(bufio.NewReader(r), queries)
+		r.Close()
+		if waitErr := wait(); err == nil {
+			err = waitErr
+		}
+		if err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Query generator failed", err))
+			os.Exit(2)
+		}
+	}()
+	return queries, nil
+}
+
+// readGeneratedLines reads queries in the line format until the end of the input
+func readGeneratedLines(r io.Reader, queries chan<- *dns.Msg) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		q, ok, err := parseQuery(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if !ok {
+			continue
+		}
+		message := new(dns.Msg).SetQuestion(q.domain, q.recordType)
+		if iterative {
+			message.RecursionDesired = false
+		}
+		queries <- message
+	}
+	return scanner.Err()
+}
+
+// readGeneratedMessages reads queries in the binary format until the end of the input
+func readGeneratedMessages(r io.Reader, queries chan<- *dns.Msg) error {
+	var length [2]byte
+	for number := 1; ; number++ {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("query %d: %s", number, err)
+		}
+		packed := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, packed); err != nil {
+			return fmt.Errorf("query %d: %s", number, err)
+		}
+		message := new(dns.Msg)
+		if err := message.Unpack(packed); err != nil {
+			return fmt.Errorf("query %d: %s", number, err)
+		}
+		if len(message.Question) != 1 {
+			return fmt.Errorf("query %d: expected a single question", number)
+		}
+		queries <- message
+	}
+}
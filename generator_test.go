@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReadGeneratedLines(t *testing.T) {
+	queries := make(chan *dns.Msg, 10)
+	err := readGeneratedLines(strings.NewReader("# comment\nexample.com A\n\nexample.org. aaaa\n"), queries)
+	if err != nil {
+		t.Fatalf("Unable to read the queries: %s", err)
+	}
+	close(queries)
+	var questions []dns.Question
+	for message := range queries {
+		questions = append(questions, message.Question[0])
+	}
+	if len(questions) != 2 || questions[0].Name != "example.com." || questions[1].Qtype != dns.TypeAAAA {
+		t.Errorf("Invalid queries: %v", questions)
+	}
+
+	if err = readGeneratedLines(strings.NewReader("example.com BAD\n"), make(chan *dns.Msg, 1)); err == nil {
+		t.Error("Invalid query types should return a non-nil error")
+	}
+}
+
+func TestReadGeneratedMessages(t *testing.T) {
+	var input bytes.Buffer
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		message := new(dns.Msg).SetQuestion(name, dns.TypeMX)
+		message.SetEdns0(1232, true)
+		packed, _ := message.Pack()
+		input.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packed))))
+		input.Write(packed)
+	}
+
+	queries := make(chan *dns.Msg, 10)
+	if err := readGeneratedMessages(bytes.NewReader(input.Bytes()), queries); err != nil {
+		t.Fatalf("Unable to read the queries: %s", err)
+	}
+	close(queries)
+	var messages []*dns.Msg
+	for message := range queries {
+		messages = append(messages, message)
+	}
+	if len(messages) != 2 || messages[1].Question[0].Name != "b.example.com." || messages[0].IsEdns0() == nil {
+		t.Errorf("Invalid queries: %v", messages)
+	}
+
+	truncated := input.Bytes()[:input.Len()-3]
+	if err := readGeneratedMessages(bytes.NewReader(truncated), make(chan *dns.Msg, 10)); err == nil {
+		t.Error("Truncated messages should return a non-nil error")
+	}
+}
+
+func TestGeneratorBackpressure(t *testing.T) {
+	defer func(c int) { concurrency = c }(concurrency)
+	concurrency = 2
+
+	// The generator writes 100 queries, but only a few are read until the workers take them
+	queries, err := startGenerator("for i in $(seq 100); do echo q$i.example.com A; done", generatorLine)
+	if err != nil {
+		t.Fatalf("Unable to start the generator: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(queries) != concurrency {
+		t.Errorf("Invalid number of buffered queries: got %d, expected %d", len(queries), concurrency)
+	}
+	received := 0
+	for range queries {
+		received++
+	}
+	if received != 100 {
+		t.Errorf("Invalid number of queries: got %d, expected 100", received)
+	}
+}
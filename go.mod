@@ -1,8 +1,20 @@
 module github.com/glebkin/dnsstresss
 
-go 1.14
+go 1.24
 
 require (
+	github.com/cloudflare/circl v1.6.1
 	github.com/logrusorgru/aurora v2.0.3+incompatible
 	github.com/miekg/dns v1.1.31
+	github.com/quic-go/quic-go v0.59.1
+	go.etcd.io/bbolt v1.4.3
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
+	golang.org/x/crypto v0.41.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/miekg/dns"
+)
+
+// Thundering herd options
+var (
+	// Number of clients sending the same query at the same instant
+	herdSize int
+	// Interval between two rounds, 0 to start each round right after the TTL of the answer
+	// expired
+	herdIntervalMs int
+)
+
+// Time waited after the TTL of the answer expired before the next round, so that the
+// resolver has dropped it from its cache
+const herdExpiryMargin = 100 * time.Millisecond
+
+// Interval between two rounds when it cannot be derived from the TTL of the answer
+const herdDefaultInterval = time.Second
+
+// herdRound is the result of a round of the thundering herd test
+type herdRound struct {
+	queries   int
+	errors    int
+	latencies latencyHistogram
+	max       time.Duration
+	// Queries for the name received by the authoritative server during the round, or -1
+	// without authoritative server
+	fetches int
+}
+
+// herdSummary sums up the rounds of the thundering herd test
+type herdSummary struct {
+	Rounds  int `json:"rounds"`
+	Queries int `json:"queries"`
+	Errors  int `json:"errors"`
+	Fetches int `json:"fetches,omitempty"`
+	// Whether the fetches were not counted, without authoritative server
+	FetchesUnknown bool          `json:"fetches_unknown,omitempty"`
+	P50            time.Duration `json:"p50"`
+	P99            time.Duration `json:"p99"`
+	Max            time.Duration `json:"max"`
+}
+
+// record adds a round to the summary
+func (s *herdSummary) record(round *herdRound) {
+	s.Rounds++
+	s.Queries += round.queries
+	s.Errors += round.errors
+	if round.fetches >= 0 {
+		s.Fetches += round.fetches
+	} else {
+		s.FetchesUnknown = true
+	}
+	if round.max > s.Max {
+		s.Max = round.max
+	}
+}
+
+// herdCounter counts the queries for the name of the herd received by the authoritative
+// server
+type herdCounter struct {
+	mu      sync.Mutex
+	name    string
+	qtype   uint16
+	fetches int
+}
+
+// watch starts counting the queries for the name and type
+func (h *herdCounter) watch(name string, qtype uint16) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.name, h.qtype = dns.CanonicalName(name), qtype
+}
+
+// record counts a query received by the authoritative server, if it is for the name
+func (h *herdCounter) record(name string, qtype uint16) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if name == h.name && qtype == h.qtype {
+		h.fetches++
+	}
+}
+
+// take returns the queries for the name received since the last call
+func (h *herdCounter) take() (fetches int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fetches = h.fetches
+	h.fetches = 0
+	return
+}
+
+// runHerd sends the message from herdSize clients at the same instant, round after round,
+// and reports each round to the stats module
+func runHerd(message *dns.Msg, channel chan<- statsMessage) {
+	question := message.Question[0]
+	if authoritative != nil {
+		authoritative.herd.watch(question.Name, question.Qtype)
+	}
+
+	// Each client keeps its own transport from one round to the next
+	events := &transportEvents{}
+	random := mrand.New(mrand.NewSource(runSeed - 1))
+	transports := make([]transport, herdSize)
+	for i := range transports {
+		share := transportMix[pickTransport(random)]
+		t, err := newTransport(share.name, share.address, events)
+		if err != nil {
+			fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to create the transport", err))
+			os.Exit(2)
+		}
+		transports[i] = t
+	}
+
+	next := time.Now()
+	for {
+		round, ttl := herdRun(message, transports, next)
+		if authoritative != nil {
+			round.fetches = authoritative.herd.take()
+		} else {
+			round.fetches = -1
+		}
+		channel <- statsMessage{herd: round}
+
+		switch {
+		case herdIntervalMs > 0:
+			next = next.Add(time.Duration(herdIntervalMs) * time.Millisecond)
+		case ttl > 0:
+			next = next.Add(ttl + herdExpiryMargin)
+		default:
+			next = next.Add(herdDefaultInterval)
+		}
+		if now := time.Now(); next.Before(now) {
+			next = now
+		}
+	}
+}
+
+// herdRun sends the message from all the transports at the given instant, and returns the
+// result of the round along with the lowest TTL of the answers
+func herdRun(message *dns.Msg, transports []transport, at time.Time) (*herdRound, time.Duration) {
+	type result struct {
+		elapsed  time.Duration
+		response *dns.Msg
+		err      error
+	}
+	results := make(chan result, len(transports))
+	release := make(chan struct{})
+	for _, t := range transports {
+		go func(t transport) {
+			query := message.Copy()
+			query.Id = dns.Id()
+			<-release
+			if authoritative != nil {
+				authoritative.amplification.record(false, query.Question[0].Qtype, query.Question[0].Name)
+			}
+			start := time.Now()
+			response, err := t.exchange(query)
+			results <- result{time.Since(start), response, err}
+		}(t)
+	}
+	time.Sleep(time.Until(at))
+	close(release)
+
+	round := &herdRound{queries: len(transports)}
+	var ttl uint32
+	for range transports {
+		r := <-results
+		round.latencies.record(r.elapsed)
+		if r.elapsed > round.max {
+			round.max = r.elapsed
+		}
+		if r.err != nil || r.response.Rcode == dns.RcodeServerFailure {
+			round.errors++
+			continue
+		}
+		for _, rr := range r.response.Answer {
+			if ttl == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	return round, time.Duration(ttl) * time.Second
+}
+
+// printHerdRound prints the result of a round of the thundering herd test
+func printHerdRound(number int, round *herdRound) {
+	fmt.Printf(
+		"%s %d queries (p50=%.0fms / p99=%.0fms / max=%.0fms)",
+		aurora.Faint(fmt.Sprintf("Herd #%d:", number)),
+		round.queries,
+		1000.*round.latencies.percentile(50).Seconds(),
+		1000.*round.latencies.percentile(99).Seconds(),
+		1000.*round.max.Seconds(),
+	)
+	if round.fetches >= 0 {
+		fmt.Printf(", %d upstream fetches", round.fetches)
+	}
+	if round.errors > 0 {
+		fmt.Printf("\t %s", aurora.Red(fmt.Sprintf("Errors: %d", round.errors)))
+	}
+	fmt.Print("\n")
+}
+
+// printHerdSummary prints the summary of the thundering herd test
+func printHerdSummary(s *herdSummary) {
+	fmt.Printf(
+		"  Herd: %d rounds of %d queries (p50=%.1fms / p99=%.1fms / max=%.1fms)",
+		s.Rounds,
+		herdSize,
+		1000.*s.P50.Seconds(),
+		1000.*s.P99.Seconds(),
+		1000.*s.Max.Seconds(),
+	)
+	if !s.FetchesUnknown && s.Rounds > 0 {
+		fmt.Printf(", %.2f upstream fetches per round", float64(s.Fetches)/float64(s.Rounds))
+	}
+	if s.Errors > 0 {
+		fmt.Printf("\t %s", aurora.Red(fmt.Sprintf("Errors: %d", s.Errors)))
+	}
+	fmt.Print("\n")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHerdRound(t *testing.T) {
+	server := newTestAuthServer(t)
+	server.herd.watch(server.names[3], dns.TypeA)
+
+	// Each client gets the answer of the authoritative server directly
+	transports := make([]transport, 20)
+	for i := range transports {
+		transports[i] = &authTransport{server}
+	}
+	at := time.Now().Add(20 * time.Millisecond)
+	round, ttl := herdRun(new(dns.Msg).SetQuestion(server.names[3], dns.TypeA), transports, at)
+	if time.Now().Before(at) {
+		t.Error("The round ended before its instant")
+	}
+	if round.queries != 20 || round.errors != 0 || round.latencies.total != 20 {
+		t.Errorf("Invalid round: %+v", round)
+	}
+	if ttl != time.Duration(authTTL)*time.Second {
+		t.Errorf("Invalid TTL: got %s", ttl)
+	}
+	if fetches := server.herd.take(); fetches != 20 {
+		t.Errorf("Invalid number of fetches: got %d, expected 20", fetches)
+	}
+}
+
+// authTransport sends the messages to an authoritative server without network
+type authTransport struct {
+	server *authServer
+}
+
+func (t *authTransport) exchange(message *dns.Msg) (*dns.Msg, error) {
+	recorder := &responseRecorder{}
+	t.server.ServeDNS(recorder, message)
+	if recorder.msg == nil {
+		return nil, errors.New("no answer")
+	}
+	return recorder.msg, nil
+}
+
+func (t *authTransport) close() {}
+
+func TestHerdSummary(t *testing.T) {
+	var summary herdSummary
+	summary.record(&herdRound{queries: 20, errors: 1, max: time.Second, fetches: 2})
+	summary.record(&herdRound{queries: 20, max: time.Millisecond, fetches: 1})
+	if summary.Rounds != 2 || summary.Queries != 40 || summary.Errors != 1 || summary.Max != time.Second {
+		t.Errorf("Invalid summary: %+v", summary)
+	}
+	if summary.Fetches != 3 || summary.FetchesUnknown {
+		t.Errorf("Invalid fetches: %d (unknown: %t)", summary.Fetches, summary.FetchesUnknown)
+	}
+
+	// Without authoritative server, the fetches are not counted
+	summary = herdSummary{}
+	summary.record(&herdRound{queries: 20, fetches: -1})
+	summary.record(&herdRound{queries: 20, fetches: -1})
+	if summary.Fetches != 0 || !summary.FetchesUnknown {
+		t.Errorf("Invalid fetches without authoritative server: %d (unknown: %t)", summary.Fetches, summary.FetchesUnknown)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Each power of two of microseconds is split in this many linear buckets, which bounds the
+// error of the percentiles to about 6%
+const histogramSubBuckets = 16
+
+// Enough buckets for any positive duration
+const histogramBuckets = 61 * histogramSubBuckets
+
+// latencyHistogram counts latencies in logarithmic buckets, to compute percentiles
+type latencyHistogram struct {
+	counts [histogramBuckets]int
+	total  int
+}
+
+// histogramBucket returns the index of the bucket of the latency
+func histogramBucket(latency time.Duration) int {
+	us := uint64(latency / time.Microsecond)
+	if latency < 0 {
+		us = 0
+	}
+	if us < histogramSubBuckets {
+		return int(us)
+	}
+	// Keep the 5 most significant bits: 1 for the power of two, 4 for the linear bucket
+	shift := bits.Len64(us) - 5
+	return (shift+1)*histogramSubBuckets + int(us>>uint(shift)) - histogramSubBuckets
+}
+
+// histogramValue returns the middle of the range of latencies counted in the bucket
+func histogramValue(bucket int) time.Duration {
+	if bucket < histogramSubBuckets {
+		return time.Duration(bucket) * time.Microsecond
+	}
+	shift := uint(bucket/histogramSubBuckets - 1)
+	low := uint64(bucket%histogramSubBuckets+histogramSubBuckets) << shift
+	high := low + 1<<shift
+	return time.Duration((low+high)/2) * time.Microsecond
+}
+
+// record adds a latency to the histogram
+func (h *latencyHistogram) record(latency time.Duration) {
+	h.counts[histogramBucket(latency)]++
+	h.total++
+}
+
+// percentile returns the latency below which p percent of the recorded latencies are, or 0
+// when the histogram is empty
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := 0
+	for bucket, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			return histogramValue(bucket)
+		}
+	}
+	return histogramValue(histogramBuckets - 1)
+}
+
+// merge adds the latencies recorded in another histogram
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	for bucket, count := range other.counts {
+		h.counts[bucket] += count
+	}
+	h.total += other.total
+}
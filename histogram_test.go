@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	// Each latency must fall in a bucket whose value is close to it
+	for _, latency := range []time.Duration{
+		0,
+		5 * time.Microsecond,
+		15 * time.Microsecond,
+		16 * time.Microsecond,
+		700 * time.Microsecond,
+		3 * time.Millisecond,
+		1234 * time.Millisecond,
+		2 * time.Hour,
+	} {
+		bucket := histogramBucket(latency)
+		if bucket < 0 || bucket >= histogramBuckets {
+			t.Fatalf("histogramBucket(%s): got out of range bucket %d", latency, bucket)
+		}
+		value := histogramValue(bucket)
+		if diff := value - latency; diff > latency/16+time.Microsecond || -diff > latency/16+time.Microsecond {
+			t.Errorf("histogramValue(histogramBucket(%s)): got %s", latency, value)
+		}
+	}
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	var h latencyHistogram
+	if h.percentile(99) != 0 {
+		t.Error("Empty histograms should return a zero percentile")
+	}
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+
+	cases := map[float64]time.Duration{
+		50:  500 * time.Millisecond,
+		99:  990 * time.Millisecond,
+		100: 1000 * time.Millisecond,
+	}
+	for p, expected := range cases {
+		got := h.percentile(p)
+		if diff := got - expected; diff > expected/16 || -diff > expected/16 {
+			t.Errorf("percentile(%v): got %s, expected about %s", p, got, expected)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Result history options
+var (
+	// Path to the database where the runs are saved (empty to disable)
+	historyPath string
+	// Tags given with -tag, saved with the run
+	runTags tagFlags
+)
+
+const defaultHistoryPath = "~/.dnsstresss/history.db"
+
+// Name of the bucket holding the runs, keyed by their sequential ID
+var historyBucket = []byte("runs")
+
+// tagFlags collects the key=value pairs given with repeated flags
+type tagFlags map[string]string
+
+func (t tagFlags) String() string {
+	var pairs []string
+	for key, value := range t {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (t *tagFlags) Set(pair string) error {
+	key, value, ok := strings.Cut(pair, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid tag %q, expected key=value", pair)
+	}
+	if *t == nil {
+		*t = make(tagFlags)
+	}
+	(*t)[key] = value
+	return nil
+}
+
+// matches tells whether all the tags are also in the other ones
+func (t tagFlags) matches(other map[string]string) bool {
+	for key, value := range t {
+		if other[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// runRecord is a run saved in the history
+type runRecord struct {
+	ID        uint64 `json:"id"`
+	Resolver  string `json:"resolver"`
+	Transport string `json:"transport"`
+	runMetadata
+	Summary runSummary `json:"summary"`
+}
+
+// newRunRecord returns the record of the current run, with its summary
+func newRunRecord(metadata runMetadata, summary runSummary) *runRecord {
+	// The transport, or the transports of a mix with their weights
+	transport := transportName
+	if len(transportMix) == 1 {
+		transport = transportMix[0].name
+	}
+	return &runRecord{
+		Resolver:    resolver,
+		Transport:   transport,
+		runMetadata: metadata,
+		Summary:     summary,
+	}
+}
+
+// openHistory opens the history database, creating it if needed
+func openHistory(path string, readOnly bool) (*bolt.DB, error) {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	if readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("no history found: %s", err)
+		}
+	} else if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// Do not wait forever when another run holds the database
+	return bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+}
+
+// saveRun adds the run to the history, and sets its ID
+func saveRun(path string, record *runRecord) error {
+	db, err := openHistory(path, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		if record.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(binary.BigEndian.AppendUint64(nil, record.ID), data)
+	})
+}
+
+// loadRuns returns the runs of the history, oldest first
+func loadRuns(path string) ([]runRecord, error) {
+	db, err := openHistory(path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var records []runRecord
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, data []byte) error {
+			var record runRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("corrupted run %d: %s", binary.BigEndian.Uint64(key), err)
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// historyCommand implements the history subcommand, and returns the exit code
+func historyCommand(args []string) int {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	path := flags.String("history", defaultHistoryPath, "Path to the history database")
+	resolverFilter := flags.String("resolver", "", "Only show the runs against resolvers containing this string")
+	transportFilter := flags.String("transport", "", "Only show the runs using this transport")
+	var tags tagFlags
+	flags.Var(&tags, "tag", "Only show the runs with this key=value tag (repeatable)")
+	last := flags.Int("last", 20, "Number of runs to show, the most recent ones (0 for all)")
+	trend := flags.Bool("trend", false, "Show the trend of the QPS and p99 latency of the runs")
+	show := flags.Uint64("show", 0, "Show the full configuration and summary of the run with this ID")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, strings.Join([]string{
+			"List the runs saved in the history, and the trends of their results.",
+			"",
+			"Usage: dnsstresss history [option ...]",
+			"",
+		}, "\n"))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	records, err := loadRuns(*path)
+	if err != nil {
+		fmt.Println(aurora.Sprintf(aurora.Red("%s (%s)"), "Unable to read the history", err))
+		return 2
+	}
+
+	if *show != 0 {
+		for _, record := range records {
+			if record.ID == *show {
+				data, _ := json.MarshalIndent(record, "", "  ")
+				fmt.Println(string(data))
+				return 0
+			}
+		}
+		fmt.Println(aurora.Sprintf(aurora.Red("No run with ID %d"), *show))
+		return 1
+	}
+
+	var selected []runRecord
+	for _, record := range records {
+		if strings.Contains(record.Resolver, *resolverFilter) &&
+			(*transportFilter == "" || record.Transport == *transportFilter) &&
+			tags.matches(record.Tags) {
+			selected = append(selected, record)
+		}
+	}
+	if *last > 0 && len(selected) > *last {
+		selected = selected[len(selected)-*last:]
+	}
+	if len(selected) == 0 {
+		fmt.Println("No runs found.")
+		return 0
+	}
+
+	if *trend {
+		printTrend(selected)
+	} else {
+		printRuns(selected)
+	}
+	return 0
+}
+
+// printRuns prints a table of the runs
+func printRuns(records []runRecord) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDate\tResolver\tTransport\tDuration\tQPS\tp99\tErrors\tTags")
+	for _, record := range records {
+		s := record.Summary
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%.0f\t%.1fms\t%d\t%s\n",
+			record.ID,
+			s.Start.Format("2006-01-02 15:04"),
+			record.Resolver,
+			record.Transport,
+			s.Duration.Round(time.Second),
+			s.qps(),
+			1000.*s.P99.Seconds(),
+			s.Errors,
+			tagFlags(record.Tags),
+		)
+	}
+	w.Flush()
+}
+
+// printTrend prints the QPS and p99 latency of the runs as bars, along with their evolution
+func printTrend(records []runRecord) {
+	const width = 30
+	maxQPS, maxP99 := 0., 0.
+	for _, record := range records {
+		if qps := record.Summary.qps(); qps > maxQPS {
+			maxQPS = qps
+		}
+		if p99 := record.Summary.P99.Seconds(); p99 > maxP99 {
+			maxP99 = p99
+		}
+	}
+	bar := func(value, max float64) string {
+		if max == 0 {
+			return ""
+		}
+		return strings.Repeat("#", round(width*value/max))
+	}
+
+	for _, record := range records {
+		s := record.Summary
+		fmt.Printf("%5d  %s  %8.0f r/s %-*s  %7.1fms %-*s\n",
+			record.ID,
+			s.Start.Format("2006-01-02 15:04"),
+			s.qps(),
+			width, bar(s.qps(), maxQPS),
+			1000.*s.P99.Seconds(),
+			width, bar(s.P99.Seconds(), maxP99),
+		)
+	}
+
+	first, latest := records[0].Summary, records[len(records)-1].Summary
+	if len(records) > 1 && first.qps() > 0 && first.P99 > 0 {
+		fmt.Printf(
+			"\n%s QPS %+.1f%%, p99 %+.1f%%\n",
+			aurora.Faint("From the first to the latest run:"),
+			100*(latest.qps()/first.qps()-1),
+			100*(latest.P99.Seconds()/first.P99.Seconds()-1),
+		)
+	}
+}
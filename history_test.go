@@ -0,0 +1,88 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTagFlags(t *testing.T) {
+	var tags tagFlags
+	for _, pair := range []string{"env=lab", "build=1.2=rc", "empty="} {
+		if err := tags.Set(pair); err != nil {
+			t.Errorf("Set(%q): got error %s", pair, err)
+		}
+	}
+	for _, pair := range []string{"novalue", "=value"} {
+		if err := tags.Set(pair); err == nil {
+			t.Errorf("Set(%q) should return a non-nil error", pair)
+		}
+	}
+	if tags.String() != "build=1.2=rc,empty=,env=lab" {
+		t.Errorf("Invalid tags: got %q", tags.String())
+	}
+
+	if !tags.matches(map[string]string{"env": "lab", "build": "1.2=rc", "empty": "", "other": "x"}) {
+		t.Error("Tags should match a superset of them")
+	}
+	if tags.matches(map[string]string{"env": "prod", "build": "1.2=rc"}) {
+		t.Error("Tags should not match different values")
+	}
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history", "runs.db")
+	if _, err := loadRuns(path); err == nil {
+		t.Error("Missing histories should return a non-nil error")
+	}
+
+	for i := 1; i <= 3; i++ {
+		record := &runRecord{
+			Resolver:    "127.0.0.1:53",
+			Transport:   transportUDP,
+			runMetadata: runMetadata{Tags: map[string]string{"run": string(rune('0' + i))}},
+			Summary:     runSummary{Start: time.Unix(int64(i), 0), Received: 100 * i, Duration: time.Second},
+		}
+		if err := saveRun(path, record); err != nil {
+			t.Fatalf("Unable to save the run: %s", err)
+		}
+		if record.ID != uint64(i) {
+			t.Errorf("Invalid run ID: got %d, expected %d", record.ID, i)
+		}
+	}
+
+	records, err := loadRuns(path)
+	if err != nil {
+		t.Fatalf("Unable to load the runs: %s", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Invalid number of runs: got %d", len(records))
+	}
+	for i, record := range records {
+		if record.ID != uint64(i+1) || record.Tags["run"] != string(rune('1'+i)) || record.Summary.qps() != float64(100*(i+1)) {
+			t.Errorf("Invalid run %d: %+v", i, record)
+		}
+	}
+}
+
+func TestNewRunRecordTransport(t *testing.T) {
+	savedName, savedResolver := transportName, resolver
+	defer func() { transportName, resolver, transportMix = savedName, savedResolver, nil }()
+
+	// A mix of a single transport is recorded as the transport itself
+	transportName, resolver = "tcp=1", "127.0.0.1"
+	if err := loadTransportMix(); err != nil {
+		t.Fatal(err)
+	}
+	if record := newRunRecord(runMetadata{}, runSummary{}); record.Transport != transportTCP || record.Resolver != "127.0.0.1:53" {
+		t.Errorf("Invalid transport of the record: %q (%s)", record.Transport, record.Resolver)
+	}
+
+	transportName = "udp=70,tcp=30"
+	if err := loadTransportMix(); err != nil {
+		t.Fatal(err)
+	}
+	if record := newRunRecord(runMetadata{}, runSummary{}); record.Transport != "udp=70,tcp=30" {
+		t.Errorf("Invalid transport of the record: %q", record.Transport)
+	}
+}
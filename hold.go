@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/miekg/dns"
+)
+
+// Connection capacity options
+var (
+	// Number of mostly idle connections held open to the resolver, besides the active workers
+	holdTarget int
+	// Number of held connections opened per second, until holdTarget is reached
+	holdRate int
+	// Interval between two queries on each held connection, to keep it open
+	holdKeepaliveMs int
+	holdKeepalive   time.Duration
+	// Factor of the initial mean latency from which the latency is considered degraded
+	holdDegradation float64
+)
+
+// runHold opens connections to the resolver at holdRate per second until holdTarget of them
+// are open, and reports them to the stats module. Connections that fail are replaced.
+func runHold(message *dns.Msg, channel chan<- statsMessage) {
+	// Connections open or being opened
+	var open int32
+
+	ticker := time.NewTicker(holdInterval(holdRate))
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadInt32(&open) >= int32(holdTarget) {
+			continue
+		}
+		atomic.AddInt32(&open, 1)
+		go func() {
+			defer atomic.AddInt32(&open, -1)
+			holdConnection(message.Copy(), channel)
+		}()
+	}
+}
+
+// holdInterval returns the interval between the openings of two held connections, at rate
+// per second. Beyond a connection per nanosecond, the connections are opened as fast as the
+// timers allow.
+func holdInterval(rate int) time.Duration {
+	interval := time.Second / time.Duration(rate)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+	return interval
+}
+
+// holdConnection opens a connection with a first query, and keeps it mostly idle, sending a
+// query every holdKeepalive, until it fails
+func holdConnection(message *dns.Msg, channel chan<- statsMessage) {
+	events := &transportEvents{}
+	t, err := newTransport(transportMix[0].name, transportMix[0].address, events)
+	if err == nil {
+		defer t.close()
+		_, err = t.exchange(message)
+	}
+	if err != nil {
+		if verbose {
+			fmt.Printf("Unable to open a held connection: %s\n", err)
+		}
+		channel <- statsMessage{heldFailed: 1, heldError: err}
+		return
+	}
+	channel <- statsMessage{heldOpened: 1}
+
+	if holdKeepalive == 0 {
+		select {}
+	}
+	for {
+		time.Sleep(holdKeepalive)
+		connections := atomic.LoadInt32(&events.connections)
+		if _, err = t.exchange(message); err != nil {
+			channel <- statsMessage{heldDropped: 1}
+			return
+		}
+		if atomic.LoadInt32(&events.connections) != connections {
+			// The resolver closed the connection while it was idle, and the transport opened
+			// a new one
+			channel <- statsMessage{heldDropped: 1, heldOpened: 1}
+		}
+	}
+}
+
+// capacityReport remembers the notable points of a connection capacity test
+type capacityReport struct {
+	// Mean latency of the active queries during the first interval
+	baseline time.Duration
+	failed   bool
+	degraded bool
+}
+
+// check prints the number of held connections from which new connections fail, and from which
+// the latency of the active queries degrades, the first time it happens
+func (c *capacityReport) check(held int, failure error, mean time.Duration) {
+	if failure != nil && !c.failed {
+		c.failed = true
+		fmt.Println(aurora.Sprintf(aurora.Yellow("New connections failing with %d connections held (%s)"), held, failure))
+	}
+	if mean == 0 {
+		return
+	}
+	if c.baseline == 0 {
+		c.baseline = mean
+	} else if !c.degraded && float64(mean) > holdDegradation*float64(c.baseline) {
+		c.degraded = true
+		fmt.Println(aurora.Sprintf(
+			aurora.Yellow("Latency degraded with %d connections held (mean=%.0fms / initial=%.0fms)"),
+			held,
+			1000.*mean.Seconds(),
+			1000.*c.baseline.Seconds(),
+		))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHoldInterval(t *testing.T) {
+	tables := []struct {
+		rate     int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{100, 10 * time.Millisecond},
+		{1000000000, time.Nanosecond},
+		// Faster than the timers: as fast as they allow, rather than a zero interval
+		{2000000000, time.Nanosecond},
+	}
+
+	for _, table := range tables {
+		if result := holdInterval(table.rate); result != table.expected {
+			t.Errorf("Invalid interval at %d connections per second: got %s but expected %s", table.rate, result, table.expected)
+		}
+	}
+}
+
+func TestCapacityReportCheck(t *testing.T) {
+	saved := holdDegradation
+	holdDegradation = 2
+	defer func() { holdDegradation = saved }()
+	refused := errors.New("connection refused")
+
+	tables := []struct {
+		held     int
+		failure  error
+		mean     time.Duration
+		baseline time.Duration
+		failed   bool
+		degraded bool
+	}{
+		// The first interval with active queries gives the baseline
+		{0, nil, 0, 0, false, false},
+		{10, nil, 10 * time.Millisecond, 10 * time.Millisecond, false, false},
+		// Up to twice the baseline, the latency is not degraded
+		{20, nil, 20 * time.Millisecond, 10 * time.Millisecond, false, false},
+		{30, refused, 15 * time.Millisecond, 10 * time.Millisecond, true, false},
+		{40, nil, 21 * time.Millisecond, 10 * time.Millisecond, true, true},
+		// Both are only reported once, and stay so
+		{50, refused, 5 * time.Millisecond, 10 * time.Millisecond, true, true},
+	}
+
+	var report capacityReport
+	for _, table := range tables {
+		report.check(table.held, table.failure, table.mean)
+		if report.baseline != table.baseline || report.failed != table.failed || report.degraded != table.degraded {
+			t.Errorf("Invalid report with %d connections held: got %+v", table.held, report)
+		}
+	}
+}
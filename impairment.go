@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+)
+
+// Network impairment options, emulated by the client on its own connections
+var (
+	// Share of the packets lost, in each direction
+	impairLoss float64
+	// Delay added to the packets, in each direction
+	impairLatencyMs int
+	impairLatency   time.Duration
+	// Maximum random variation of the delay, above or below it
+	impairJitterMs int
+	impairJitter   time.Duration
+	// Share of the packets held back for twice their delay, so that the next datagrams
+	// overtake them, while the stream waits for them
+	impairReorder float64
+)
+
+// Delay after which a segment lost on a stream connection is sent again, the minimum
+// retransmission timeout of Linux
+const impairRetransmit = 200 * time.Millisecond
+
+// Number of packets received and not read yet beyond which the reading of the connection is
+// paused
+const impairBacklog = 64
+
+// impairing tells whether the connections to the resolver are impaired
+func impairing() bool {
+	return impairLoss > 0 || impairLatency > 0 || impairJitter > 0
+}
+
+// Packets dropped by the impairment since the start of the run, updated atomically
+var impairLost struct {
+	sent     int64
+	received int64
+}
+
+// impairDropped picks whether a packet is lost
+func impairDropped() bool {
+	return impairLoss > 0 && rand.Float64() < impairLoss
+}
+
+// impairDelay picks the delay of a packet, twice as long for those held back to be reordered
+func impairDelay() time.Duration {
+	delay := impairLatency
+	if impairJitter > 0 {
+		delay += time.Duration((2*rand.Float64() - 1) * float64(impairJitter))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if impairReorder > 0 && rand.Float64() < impairReorder {
+		delay *= 2
+	}
+	return delay
+}
+
+// impairedPacket is a packet, or a part of the stream, delayed by the impairment
+type impairedPacket struct {
+	data []byte
+	err  error
+	// Instant from which the packet may be delivered
+	due time.Time
+}
+
+// impairedConn is a connection to the resolver losing, delaying and reordering its packets
+// like a poor network would, both before they are sent and after they are received. The
+// datagrams are lost or reordered on their own, while a stream keeps its order: its next
+// segments wait for those held back, or lost until their retransmission.
+type impairedConn struct {
+	net.Conn
+	datagram bool
+
+	// Packets received, in order of delivery
+	received chan impairedPacket
+	// Packets to send on a stream, in order
+	sending chan impairedPacket
+	closed  chan struct{}
+	once    sync.Once
+
+	mu sync.Mutex
+	// The reads wait for the packets on their own, so the connection itself is never read
+	// with a deadline
+	readDeadline time.Time
+	// Packet received and not entirely read yet
+	head *impairedPacket
+	// Error of the last write on a stream
+	err error
+	// Instant at which the last packet of the stream is delivered in each direction, so that
+	// the next ones are not delivered before
+	lastSent     time.Time
+	lastReceived time.Time
+}
+
+func newImpairedConn(conn net.Conn, datagram bool) *impairedConn {
+	c := &impairedConn{
+		Conn:     conn,
+		datagram: datagram,
+		received: make(chan impairedPacket, impairBacklog),
+		closed:   make(chan struct{}),
+	}
+	go c.receive()
+	if !datagram {
+		c.sending = make(chan impairedPacket, impairBacklog)
+		go c.send()
+	}
+	return c
+}
+
+// deliver queues a received packet for the reads, unless the connection is closed
+func (c *impairedConn) deliver(packet impairedPacket) {
+	select {
+	case c.received <- packet:
+	case <-c.closed:
+	}
+}
+
+// receive reads the packets of the connection as they arrive, and queues them for the reads
+// once they are delayed
+func (c *impairedConn) receive() {
+	buffer := make([]byte, 65536)
+	for {
+		n, err := c.Conn.Read(buffer)
+		if err != nil {
+			c.deliver(impairedPacket{err: err})
+			return
+		}
+		lost := impairDropped()
+		if lost {
+			atomic.AddInt64(&impairLost.received, 1)
+		}
+		data := append([]byte(nil), buffer[:n]...)
+		if c.datagram {
+			if lost {
+				continue
+			}
+			time.AfterFunc(impairDelay(), func() { c.deliver(impairedPacket{data: data}) })
+			continue
+		}
+		due := time.Now().Add(impairDelay())
+		if lost {
+			due = due.Add(impairRetransmit)
+		}
+		if due.Before(c.lastReceived) {
+			due = c.lastReceived
+		}
+		c.lastReceived = due
+		c.deliver(impairedPacket{data: data, due: due})
+	}
+}
+
+// send writes the packets of the stream on the connection once they are delayed
+func (c *impairedConn) send() {
+	for {
+		select {
+		case packet := <-c.sending:
+			time.Sleep(time.Until(packet.due))
+			if _, err := c.Conn.Write(packet.data); err != nil {
+				c.mu.Lock()
+				c.err = err
+				c.mu.Unlock()
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *impairedConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	head := c.head
+	c.head = nil
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if head == nil {
+		select {
+		case packet := <-c.received:
+			head = &packet
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	if head.err != nil {
+		// The connection is over: so are the next reads
+		c.mu.Lock()
+		c.head = head
+		c.mu.Unlock()
+		return 0, head.err
+	}
+
+	if wait := time.Until(head.due); wait > 0 {
+		if !deadline.IsZero() && deadline.Before(head.due) {
+			<-timeout
+			c.mu.Lock()
+			c.head = head
+			c.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		time.Sleep(wait)
+	}
+	n := copy(p, head.data)
+	if !c.datagram && n < len(head.data) {
+		// Keep the rest of the stream for the next read
+		head.data = head.data[n:]
+		c.mu.Lock()
+		c.head = head
+		c.mu.Unlock()
+	}
+	return n, nil
+}
+
+func (c *impairedConn) Write(p []byte) (int, error) {
+	lost := impairDropped()
+	if lost {
+		atomic.AddInt64(&impairLost.sent, 1)
+	}
+	data := append([]byte(nil), p...)
+	if c.datagram {
+		if lost {
+			// Lost on the way, the caller cannot tell
+			return len(p), nil
+		}
+		delay := impairDelay()
+		if delay == 0 {
+			return c.Conn.Write(p)
+		}
+		time.AfterFunc(delay, func() { c.Conn.Write(data) })
+		return len(p), nil
+	}
+
+	c.mu.Lock()
+	if err := c.err; err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	due := time.Now().Add(impairDelay())
+	if lost {
+		due = due.Add(impairRetransmit)
+	}
+	if due.Before(c.lastSent) {
+		due = c.lastSent
+	}
+	c.lastSent = due
+	c.mu.Unlock()
+	select {
+	case c.sending <- impairedPacket{data: data, due: due}:
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+	return len(p), nil
+}
+
+func (c *impairedConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *impairedConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *impairedConn) SetWriteDeadline(t time.Time) error {
+	if !c.datagram {
+		// The segments of the stream are written later, in the background
+		return nil
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *impairedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// impairedPacketConn is an impaired UDP socket, that the DNS library reads and writes
+// without the length prefix of the streams
+type impairedPacketConn struct {
+	*impairedConn
+}
+
+func (c impairedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.RemoteAddr(), err
+}
+
+func (c impairedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+// impairmentSummary sums up the packets lost by the impairment during the run
+type impairmentSummary struct {
+	LostSent     int64 `json:"lost_sent"`
+	LostReceived int64 `json:"lost_received"`
+}
+
+func takeImpairmentSummary() *impairmentSummary {
+	return &impairmentSummary{
+		LostSent:     atomic.LoadInt64(&impairLost.sent),
+		LostReceived: atomic.LoadInt64(&impairLost.received),
+	}
+}
+
+// printImpairmentSummary prints the number of packets lost by the impairment
+func printImpairmentSummary(s *impairmentSummary) {
+	fmt.Printf(
+		"  Impairment: %s (%d sent / %d received)\n",
+		aurora.Faint(fmt.Sprintf("%d packets lost", s.LostSent+s.LostReceived)),
+		s.LostSent,
+		s.LostReceived,
+	)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestImpairedStream(t *testing.T) {
+	impairLatency = 20 * time.Millisecond
+	defer func() { impairLatency = 0 }()
+
+	client, server := net.Pipe()
+	conn := newImpairedConn(client, false)
+	defer conn.Close()
+	defer server.Close()
+
+	start := time.Now()
+	if _, err := conn.Write([]byte("hello ")); err != nil {
+		t.Fatalf("Unable to write: %s", err)
+	}
+	conn.Write([]byte("world"))
+	buffer := make([]byte, 11)
+	if _, err := io.ReadFull(server, buffer); err != nil || string(buffer) != "hello world" {
+		t.Fatalf("Invalid stream sent: %q (%v)", buffer, err)
+	}
+	if elapsed := time.Since(start); elapsed < impairLatency {
+		t.Errorf("The stream was sent after %s, expected at least %s", elapsed, impairLatency)
+	}
+
+	// Read in small parts, in order
+	start = time.Now()
+	go server.Write([]byte("0123456789"))
+	var received []byte
+	for len(received) < 10 {
+		part := make([]byte, 3)
+		n, err := conn.Read(part)
+		if err != nil {
+			t.Fatalf("Unable to read: %s", err)
+		}
+		received = append(received, part[:n]...)
+	}
+	if string(received) != "0123456789" {
+		t.Errorf("Invalid stream received: %q", received)
+	}
+	if elapsed := time.Since(start); elapsed < impairLatency {
+		t.Errorf("The stream was received after %s, expected at least %s", elapsed, impairLatency)
+	}
+}
+
+func TestImpairedDeadline(t *testing.T) {
+	impairLatency = 50 * time.Millisecond
+	defer func() { impairLatency = 0 }()
+
+	client, server := net.Pipe()
+	conn := newImpairedConn(client, false)
+	defer conn.Close()
+	defer server.Close()
+
+	go server.Write([]byte("late"))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	buffer := make([]byte, 4)
+	if _, err := conn.Read(buffer); err == nil {
+		t.Fatal("The read should have timed out")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Invalid error: %s", err)
+	}
+	// The packet is still delivered to the next read
+	conn.SetReadDeadline(time.Time{})
+	if n, err := conn.Read(buffer); err != nil || string(buffer[:n]) != "late" {
+		t.Errorf("Invalid read after the timeout: %q (%v)", buffer[:n], err)
+	}
+}
+
+func TestImpairedDatagrams(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer server.Close()
+	impairLoss = 1
+	defer func() { impairLoss = 0 }()
+	before := impairLost.sent
+
+	conn, err := dialDatagram(server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(net.PacketConn); !ok {
+		t.Fatal("The impaired UDP socket should be a packet connection")
+	}
+	if n, err := conn.Write([]byte("lost")); err != nil || n != 4 {
+		t.Fatalf("A lost packet should look sent: %d bytes (%v)", n, err)
+	}
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := server.ReadFrom(make([]byte, 16)); err == nil {
+		t.Error("The lost packet was received")
+	}
+	if lost := impairLost.sent - before; lost != 1 {
+		t.Errorf("Invalid number of lost packets: %d, expected 1", lost)
+	}
+
+	// Without loss, the datagrams get through whole
+	impairLoss = 0
+	impairLatency = 5 * time.Millisecond
+	impairReorder = 1
+	defer func() { impairLatency, impairReorder = 0, 0 }()
+	conn.Write([]byte("query"))
+	buffer := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := server.ReadFrom(buffer)
+	if err != nil || !bytes.Equal(buffer[:n], []byte("query")) {
+		t.Fatalf("Invalid datagram sent: %q (%v)", buffer[:n], err)
+	}
+	server.WriteTo([]byte("answer"), addr)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err = conn.Read(buffer); err != nil || string(buffer[:n]) != "answer" {
+		t.Errorf("Invalid datagram received: %q (%v)", buffer[:n], err)
+	}
+}
+
+func TestImpairedReorder(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer server.Close()
+	impairLatency = 20 * time.Millisecond
+	defer func() { impairLatency, impairReorder = 0, 0 }()
+
+	conn, err := dialDatagram(server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+	impairReorder = 1
+	conn.Write([]byte("first"))
+	impairReorder = 0
+	conn.Write([]byte("second"))
+	var received []string
+	buffer := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	for len(received) < 2 {
+		n, _, err := server.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("Unable to read: %s", err)
+		}
+		received = append(received, string(buffer[:n]))
+	}
+	if received[0] != "second" || received[1] != "first" {
+		t.Errorf("The held back datagram should have been overtaken: %q", received)
+	}
+
+	// A stream keeps its order, the next segments wait for those held back
+	client, peer := net.Pipe()
+	stream := newImpairedConn(client, false)
+	defer stream.Close()
+	defer peer.Close()
+	start := time.Now()
+	impairReorder = 1
+	stream.Write([]byte("first "))
+	impairReorder = 0
+	stream.Write([]byte("second"))
+	buffer = make([]byte, 12)
+	if _, err := io.ReadFull(peer, buffer); err != nil || string(buffer) != "first second" {
+		t.Fatalf("Invalid stream sent: %q (%v)", buffer, err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*impairLatency {
+		t.Errorf("The stream was sent after %s, expected at least %s", elapsed, 2*impairLatency)
+	}
+}
+
+func TestUDPTransportShared(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer server.Close()
+	impairLatency = time.Millisecond
+	defer func() { impairLatency = 0 }()
+
+	// Answer the second query late to the first one, with the same Id, then to itself
+	go func() {
+		var first *dns.Msg
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			query := new(dns.Msg)
+			query.Unpack(buffer[:n])
+			if first != nil {
+				late := new(dns.Msg).SetReply(first)
+				late.Id = query.Id
+				packed, _ := late.Pack()
+				server.WriteTo(packed, addr)
+			}
+			first = query
+			answer, _ := new(dns.Msg).SetReply(query).Pack()
+			server.WriteTo(answer, addr)
+		}
+	}()
+
+	transport := &udpTransport{address: server.LocalAddr().String()}
+	defer transport.close()
+	for i := 0; i < 2; i++ {
+		query := new(dns.Msg).SetQuestion(fmt.Sprintf("%d.example.org.", i), dns.TypeA)
+		query.Id = 100
+		response, err := transport.exchange(query)
+		if err != nil {
+			t.Fatalf("Unable to exchange the query %d: %s", i, err)
+		}
+		if response.Question[0].Name != query.Question[0].Name {
+			t.Errorf("Invalid answer to the query %d: %s", i, response.Question[0].Name)
+		}
+	}
+}
+
+func TestUDPTransportFlood(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer server.Close()
+	impairLatency = time.Millisecond
+	flood = true
+	defer func() { impairLatency, flood = 0, false }()
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			query := new(dns.Msg)
+			query.Unpack(buffer[:n])
+			answer, _ := new(dns.Msg).SetReply(query).Pack()
+			server.WriteTo(answer, addr)
+		}
+	}()
+
+	// The flooding workers exchange their messages concurrently on the same transport
+	transport := &udpTransport{address: server.LocalAddr().String()}
+	defer transport.close()
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := transport.exchange(new(dns.Msg).SetQuestion("example.org.", dns.TypeA))
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Unable to exchange: %s", err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/logrusorgru/aurora"
+)
+
+// Run metadata options
+var (
+	// Path to a file holding options, one per line
+	configPath string
+	// Seed of the random choices of the workers, 0 to pick one
+	runSeed int64
+)
+
+// runMetadata describes the setup that produced the results of a run
+type runMetadata struct {
+	Version string `json:"version"`
+	Host    string `json:"host"`
+	Kernel  string `json:"kernel"`
+	CPUs    int    `json:"cpus"`
+	Seed    int64  `json:"seed"`
+	// Tags given with -tag or in the configuration file
+	Tags map[string]string `json:"tags,omitempty"`
+	// Value of every option, including the default ones, and the domains given as arguments
+	Config map[string]string `json:"config"`
+	Args   []string          `json:"args,omitempty"`
+}
+
+// metadata describes the current run, once the options are parsed
+var metadata runMetadata
+
+// newRunMetadata returns the metadata of the current run
+func newRunMetadata() runMetadata {
+	m := runMetadata{
+		Version: toolVersion(),
+		Kernel:  kernelVersion(),
+		CPUs:    runtime.NumCPU(),
+		Seed:    runSeed,
+		Tags:    runTags,
+		Config:  make(map[string]string),
+		Args:    flag.Args(),
+	}
+	m.Host, _ = os.Hostname()
+	flag.VisitAll(func(f *flag.Flag) {
+		m.Config[f.Name] = f.Value.String()
+	})
+	return m
+}
+
+// toolVersion returns the version of dnsstresss, or the commit it was built from
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	version := "devel"
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && len(setting.Value) >= 12:
+			version += " " + setting.Value[:12]
+		case setting.Key == "vcs.modified" && setting.Value == "true":
+			version += "+dirty"
+		}
+	}
+	return version
+}
+
+// kernelVersion returns the operating system, and the release of its kernel when known
+func kernelVersion() string {
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return runtime.GOOS + "/" + runtime.GOARCH
+	}
+	return runtime.GOOS + "/" + runtime.GOARCH + " " + strings.TrimSpace(string(release))
+}
+
+// printMetadata prints the metadata of the run, and the options that differ from the
+// default ones
+func printMetadata(m runMetadata) {
+	line := fmt.Sprintf("dnsstresss %s on %s (%s, %d CPUs), seed %d", m.Version, m.Host, m.Kernel, m.CPUs, m.Seed)
+	if len(m.Tags) > 0 {
+		line += ", tags " + tagFlags(m.Tags).String()
+	}
+	fmt.Println(aurora.Faint(line))
+
+	var options []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if value := m.Config[f.Name]; value != f.DefValue {
+			options = append(options, fmt.Sprintf("-%s=%s", f.Name, value))
+		}
+	})
+	sort.Strings(options)
+	if len(options) > 0 {
+		fmt.Println(aurora.Faint("Options: " + strings.Join(options, " ")))
+	}
+}
+
+// loadConfig sets the options given in the configuration file, unless they were given on the
+// command line. Each line holds an option name and its value, separated with "=" or spaces
+// (e.g. "concurrency = 10"). Boolean options may be given without value, and repeated options
+// like tag on several lines. Blank lines and lines starting with # are ignored.
+func loadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	scanner := bufio.NewScanner(f)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value := line, ""
+		if end := strings.IndexAny(line, "= \t"); end >= 0 {
+			name = line[:end]
+			value = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[end:]), "="))
+		}
+		name = strings.TrimLeft(name, "-")
+		option := flag.Lookup(name)
+		if name == "config" || option == nil {
+			return fmt.Errorf("line %d: unknown option %q", number, name)
+		}
+		if boolean, ok := option.Value.(interface{ IsBoolFlag() bool }); ok && boolean.IsBoolFlag() && value == "" {
+			value = "true"
+		}
+		if explicit[name] && name != "tag" {
+			continue
+		}
+		if err = flag.Set(name, value); err != nil {
+			return fmt.Errorf("line %d: invalid value %q for %s: %s", number, value, name, err)
+		}
+	}
+	return scanner.Err()
+}
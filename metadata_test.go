@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	defer func(c int, v bool, tags tagFlags) { concurrency, verbose, runTags = c, v, tags }(concurrency, verbose, runTags)
+	runTags = tagFlags{"host": "ns1"}
+
+	path := filepath.Join(t.TempDir(), "run.conf")
+	content := "# Lab setup\n\nconcurrency = 7\n-v\ntag env=lab\ntag=build=1.2\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path); err != nil {
+		t.Fatalf("Unable to load the configuration: %s", err)
+	}
+	if concurrency != 7 || !verbose {
+		t.Errorf("Invalid options: concurrency=%d, v=%t", concurrency, verbose)
+	}
+	if runTags.String() != "build=1.2,env=lab,host=ns1" {
+		t.Errorf("Invalid tags: %s", runTags)
+	}
+
+	for _, content := range []string{"unknown = 1\n", "chaosRatio = many\n", "config = other.conf\n"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(path); err == nil {
+			t.Errorf("Invalid configuration %q should return a non-nil error", content)
+		}
+	}
+}
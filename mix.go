@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transportShare is a transport of the mix, with the share of the queries it sends
+type transportShare struct {
+	name    string
+	weight  float64
+	address string
+}
+
+// transportMix holds the transports given with -transport, a single one unless a mix was given
+var transportMix []transportShare
+
+// transportStats are the stats of the queries sent with a transport of the mix
+type transportStats struct {
+	sent       int
+	err        int
+	elapsed    time.Duration
+	maxElapsed time.Duration
+	latencies  latencyHistogram
+}
+
+// record adds a query to the stats
+func (s *transportStats) record(elapsed time.Duration, failed bool) {
+	s.sent++
+	if failed {
+		s.err++
+	}
+	s.elapsed += elapsed
+	if elapsed > s.maxElapsed {
+		s.maxElapsed = elapsed
+	}
+	s.latencies.record(elapsed)
+}
+
+// add sums the stats of other queries into the totals
+func (s *transportStats) add(added *transportStats) {
+	s.sent += added.sent
+	s.err += added.err
+	s.elapsed += added.elapsed
+	if added.maxElapsed > s.maxElapsed {
+		s.maxElapsed = added.maxElapsed
+	}
+	s.latencies.merge(&added.latencies)
+}
+
+// parseTransportMix parses a transport name, or a comma-separated list of transports with
+// their weight (e.g. udp=70,tcp=10,doh=15,dot=5)
+func parseTransportMix(spec string) ([]transportShare, error) {
+	if !strings.Contains(spec, "=") {
+		if _, ok := transportPorts[spec]; !ok {
+			return nil, fmt.Errorf("unknown transport %q", spec)
+		}
+		return []transportShare{{name: spec, weight: 1}}, nil
+	}
+
+	var mix []transportShare
+	seen := make(map[string]bool)
+	for _, item := range splitList(spec) {
+		name, weight, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid transport share %q, expected transport=weight", item)
+		}
+		if _, ok := transportPorts[name]; !ok {
+			return nil, fmt.Errorf("unknown transport %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("transport %q given twice", name)
+		}
+		seen[name] = true
+		share := transportShare{name: name}
+		var err error
+		if share.weight, err = strconv.ParseFloat(weight, 64); err != nil || share.weight <= 0 {
+			return nil, fmt.Errorf("invalid weight %q for transport %q", weight, name)
+		}
+		mix = append(mix, share)
+	}
+	return mix, nil
+}
+
+// parseResolvers returns the resolver of each transport, when the resolver is given as a
+// comma-separated list of transport=address, or the same resolver for all of them otherwise
+func parseResolvers(input string, mix []transportShare) (map[string]string, error) {
+	resolvers := make(map[string]string)
+	items := splitList(input)
+	perTransport := len(items) > 0
+	for _, item := range items {
+		name, _, ok := strings.Cut(item, "=")
+		if _, known := transportPorts[name]; !ok || !known {
+			perTransport = false
+		}
+	}
+	if !perTransport {
+		for _, share := range mix {
+			resolvers[share.name] = input
+		}
+		return resolvers, nil
+	}
+
+	for _, item := range items {
+		name, address, _ := strings.Cut(item, "=")
+		resolvers[name] = address
+	}
+	for _, share := range mix {
+		if resolvers[share.name] == "" {
+			return nil, fmt.Errorf("no resolver given for transport %q", share.name)
+		}
+	}
+	return resolvers, nil
+}
+
+// loadTransportMix parses the transports and the resolvers given on the command line
+func loadTransportMix() error {
+	mix, err := parseTransportMix(transportName)
+	if err != nil {
+		return err
+	}
+	resolvers, err := parseResolvers(resolver, mix)
+	if err != nil {
+		return err
+	}
+
+	for i, share := range mix {
+		input := resolvers[share.name]
+		if isDNSCryptTransport(share.name) {
+			if input, err = loadDNSCryptOptions(input); err != nil {
+				return fmt.Errorf("invalid DNSCrypt options: %s", err)
+			}
+		}
+		if mix[i].address, err = resolverAddress(share.name, input); err != nil {
+			return fmt.Errorf("unable to parse the resolver address of %s: %s", share.name, err)
+		}
+	}
+	transportMix = mix
+	if len(mix) == 1 {
+		resolver = mix[0].address
+	}
+	return nil
+}
+
+// mixHas tells whether one of the transports of the mix satisfies the condition
+func mixHas(condition func(name string) bool) bool {
+	for _, share := range transportMix {
+		if condition(share.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// pickTransport returns the index of a transport of the mix, picked according to the weights
+func pickTransport(random *rand.Rand) int {
+	if len(transportMix) == 1 {
+		return 0
+	}
+	total := 0.
+	for _, share := range transportMix {
+		total += share.weight
+	}
+	pick := random.Float64() * total
+	for i, share := range transportMix {
+		if pick < share.weight {
+			return i
+		}
+		pick -= share.weight
+	}
+	return len(transportMix) - 1
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestParseTransportMix(t *testing.T) {
+	mix, err := parseTransportMix("udp=70, tcp=10,doh=15,dot=5")
+	if err != nil {
+		t.Fatalf("Unable to parse the mix: %s", err)
+	}
+	expected := []transportShare{{name: "udp", weight: 70}, {name: "tcp", weight: 10}, {name: "doh", weight: 15}, {name: "dot", weight: 5}}
+	if !reflect.DeepEqual(mix, expected) {
+		t.Errorf("Invalid mix: got %v", mix)
+	}
+
+	if mix, err = parseTransportMix("dot"); err != nil || len(mix) != 1 || mix[0].name != "dot" {
+		t.Errorf("Invalid single transport: got %v (%v)", mix, err)
+	}
+
+	for _, spec := range []string{"quic", "udp=1,quic=1", "udp=0", "udp=x", "udp=1,udp=2", "udp=1,tcp"} {
+		if _, err = parseTransportMix(spec); err == nil {
+			t.Errorf("Invalid mix %q should return a non-nil error", spec)
+		}
+	}
+}
+
+func TestParseResolvers(t *testing.T) {
+	mix := []transportShare{{name: "udp"}, {name: "doh"}}
+	cases := []struct {
+		input    string
+		expected map[string]string
+	}{
+		{"10.0.0.1", map[string]string{"udp": "10.0.0.1", "doh": "10.0.0.1"}},
+		{"https://dns.example.com/dns-query?a=b", map[string]string{"udp": "https://dns.example.com/dns-query?a=b", "doh": "https://dns.example.com/dns-query?a=b"}},
+		{"udp=10.0.0.1:5353,doh=https://dns.example.com/q", map[string]string{"udp": "10.0.0.1:5353", "doh": "https://dns.example.com/q"}},
+	}
+	for _, c := range cases {
+		resolvers, err := parseResolvers(c.input, mix)
+		if err != nil || !reflect.DeepEqual(resolvers, c.expected) {
+			t.Errorf("parseResolvers(%q): got %v (%v)", c.input, resolvers, err)
+		}
+	}
+
+	if _, err := parseResolvers("udp=10.0.0.1", mix); err == nil {
+		t.Error("Missing resolvers should return a non-nil error")
+	}
+}
+
+func TestPickTransport(t *testing.T) {
+	transportMix = []transportShare{{name: "udp", weight: 70}, {name: "tcp", weight: 10}, {name: "doh", weight: 20}}
+	defer func() { transportMix = nil }()
+
+	random := rand.New(rand.NewSource(1))
+	counts := make([]int, len(transportMix))
+	for i := 0; i < 10000; i++ {
+		counts[pickTransport(random)]++
+	}
+	for i, expected := range []int{7000, 1000, 2000} {
+		if counts[i] < expected*9/10 || counts[i] > expected*11/10 {
+			t.Errorf("Transport %s picked %d times, expected about %d", transportMix[i].name, counts[i], expected)
+		}
+	}
+}
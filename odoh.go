@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Oblivious DoH options
+var (
+	// URL of the relay forwarding the queries to the target (the resolver)
+	odohRelay string
+	// Every N queries, the same query is also sent directly to the target
+	odohProbe int
+)
+
+// Constants of the ODoH protocol (RFC 9230)
+const (
+	odohConfigVersion   = 0x0001
+	odohMessageQuery    = 0x01
+	odohMessageResponse = 0x02
+	odohContentType     = "application/oblivious-dns-message"
+	odohConfigsPath     = "/.well-known/odohconfigs"
+)
+
+// Hash functions of the HPKE KDFs
+var odohHashes = map[uint16]func() hash.Hash{
+	0x0001: sha256.New,
+	0x0002: sha512.New384,
+	0x0003: sha512.New,
+}
+
+// odohConfig is the public key configuration of an ODoH target
+type odohConfig struct {
+	publicKey kem.PublicKey
+	suite     hpke.Suite
+	hash      func() hash.Hash
+	aeadID    uint16
+	keyID     []byte
+}
+
+// odohQuery is an encrypted query, along with what is needed to decrypt its response
+type odohQuery struct {
+	plaintext []byte
+	sealer    hpke.Sealer
+}
+
+// readPrefixed reads a field prefixed with its uint16 length, and returns it along with the
+// rest of the data
+func readPrefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated field length")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return nil, nil, errors.New("truncated field")
+	}
+	return data[2 : 2+length], data[2+length:], nil
+}
+
+// appendPrefixed appends a field prefixed with its uint16 length
+func appendPrefixed(data []byte, field []byte) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(field)))
+	return append(data, field...)
+}
+
+// parseODoHConfigs returns the first configuration supported among the ones published by a
+// target
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	configs, _, err := readPrefixed(data)
+	if err != nil {
+		return nil, err
+	}
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, errors.New("truncated ODoH config")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		var contents []byte
+		contents, configs, err = readPrefixed(configs[2:])
+		if err != nil {
+			return nil, err
+		}
+		if version != odohConfigVersion {
+			continue
+		}
+		if config, err := parseODoHConfigContents(contents); err == nil {
+			return config, nil
+		}
+	}
+	return nil, errors.New("no supported ODoH config")
+}
+
+// parseODoHConfigContents parses the HPKE suite and public key of a configuration
+func parseODoHConfigContents(contents []byte) (*odohConfig, error) {
+	if len(contents) < 6 {
+		return nil, errors.New("truncated ODoH config")
+	}
+	kemID := binary.BigEndian.Uint16(contents)
+	kdfID := binary.BigEndian.Uint16(contents[2:])
+	aeadID := binary.BigEndian.Uint16(contents[4:])
+	publicKey, _, err := readPrefixed(contents[6:])
+	if err != nil {
+		return nil, err
+	}
+
+	config := &odohConfig{aeadID: aeadID, hash: odohHashes[kdfID]}
+	if config.hash == nil {
+		return nil, fmt.Errorf("unsupported KDF %#04x", kdfID)
+	}
+	kemAlg, kdfAlg, aeadAlg := hpke.KEM(kemID), hpke.KDF(kdfID), hpke.AEAD(aeadID)
+	if !kemAlg.IsValid() || !kdfAlg.IsValid() || !aeadAlg.IsValid() {
+		return nil, fmt.Errorf("unsupported HPKE suite %#04x/%#04x/%#04x", kemID, kdfID, aeadID)
+	}
+	if config.publicKey, err = kemAlg.Scheme().UnmarshalBinaryPublicKey(publicKey); err != nil {
+		return nil, err
+	}
+	config.suite = hpke.NewSuite(kemAlg, kdfAlg, aeadAlg)
+
+	// The key ID identifies the configuration used to encrypt the queries
+	prk, err := hkdf.Extract(config.hash, contents, nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.keyID, err = hkdf.Expand(config.hash, prk, "odoh key id", config.hash().Size()); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// encryptQuery returns the ObliviousDoHMessage carrying the packed DNS query
+func (c *odohConfig) encryptQuery(packed []byte) ([]byte, *odohQuery, error) {
+	// ObliviousDoHMessagePlaintext, with no padding
+	plaintext := appendPrefixed(nil, packed)
+	plaintext = appendPrefixed(plaintext, nil)
+
+	sender, err := c.suite.NewSender(c.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	aad := appendPrefixed([]byte{odohMessageQuery}, c.keyID)
+	ciphertext, err := sealer.Seal(plaintext, aad)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message := appendPrefixed([]byte{odohMessageQuery}, c.keyID)
+	message = appendPrefixed(message, append(enc, ciphertext...))
+	return message, &odohQuery{plaintext: plaintext, sealer: sealer}, nil
+}
+
+// decryptResponse returns the packed DNS response carried by an ObliviousDoHMessage
+func (c *odohConfig) decryptResponse(query *odohQuery, message []byte) ([]byte, error) {
+	if len(message) < 1 || message[0] != odohMessageResponse {
+		return nil, errors.New("not an ODoH response")
+	}
+	responseNonce, rest, err := readPrefixed(message[1:])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, _, err := readPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	keySize, nonceSize := 16, 12
+	if c.aeadID != 0x0001 {
+		keySize = 32
+	}
+	secret := query.sealer.Export([]byte("odoh response"), uint(keySize))
+	salt := appendPrefixed(append([]byte{}, query.plaintext...), responseNonce)
+	prk, err := hkdf.Extract(c.hash, secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Expand(c.hash, prk, "odoh key", keySize)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(c.hash, prk, "odoh nonce", nonceSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var aead cipher.AEAD
+	if c.aeadID == 0x0003 {
+		aead, err = chacha20poly1305.New(key)
+	} else {
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	aad := appendPrefixed([]byte{odohMessageResponse}, responseNonce)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, _, err := readPrefixed(plaintext)
+	return packed, err
+}
+
+// odohCounter accumulates the latency of the sampled ODoH queries, sent both through the relay
+// and directly to the target
+type odohCounter struct {
+	mu       sync.Mutex
+	samples  int
+	viaRelay time.Duration
+	direct   time.Duration
+}
+
+// record adds a sampled query to the counter
+func (o *odohCounter) record(viaRelay time.Duration, direct time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.samples++
+	o.viaRelay += viaRelay
+	o.direct += direct
+}
+
+// take returns the sampled queries recorded since the last call
+func (o *odohCounter) take() (samples int, viaRelay time.Duration, direct time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	samples, viaRelay, direct = o.samples, o.viaRelay, o.direct
+	o.samples, o.viaRelay, o.direct = 0, 0, 0
+	return
+}
+
+// odohConfigEntry is a configuration of the cache, or the fetch of it in progress
+type odohConfigEntry struct {
+	config *odohConfig
+	err    error
+	// Closed once the configuration is fetched
+	fetched chan struct{}
+}
+
+// odohConfigCache holds the configuration of each target, fetched once and shared by all the
+// workers, or fetched again after an error
+type odohConfigCache struct {
+	mu      sync.Mutex
+	entries map[string]*odohConfigEntry
+}
+
+var odohConfigs = &odohConfigCache{entries: make(map[string]*odohConfigEntry)}
+
+// get returns the configuration of the target, fetching it when needed. The workers needing
+// the configuration of a target wait for a single fetch, without blocking the others.
+func (c *odohConfigCache) get(targetURL string, fetch func() (*odohConfig, error)) (*odohConfig, error) {
+	c.mu.Lock()
+	entry := c.entries[targetURL]
+	if entry != nil {
+		select {
+		case <-entry.fetched:
+			if entry.err != nil {
+				entry = nil
+			}
+		default:
+			// Being fetched by another worker: wait for it
+		}
+	}
+	if entry == nil {
+		entry = &odohConfigEntry{fetched: make(chan struct{})}
+		c.entries[targetURL] = entry
+		c.mu.Unlock()
+		entry.config, entry.err = fetch()
+		close(entry.fetched)
+		return entry.config, entry.err
+	}
+	c.mu.Unlock()
+	<-entry.fetched
+	return entry.config, entry.err
+}
+
+// odohTransport sends encrypted queries to the target through the relay
+type odohTransport struct {
+	targetURL string
+	relayURL  string
+	target    *http.Client
+	relay     *http.Client
+	events    *transportEvents
+	exchanges int
+}
+
+func newODoHTransport(targetURL string, events *transportEvents) (*odohTransport, error) {
+	if odohRelay == "" {
+		return nil, errors.New("the odoh transport needs a relay (-odohRelay)")
+	}
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := url.Parse(odohRelay)
+	if err != nil {
+		return nil, err
+	}
+	query := relay.Query()
+	query.Set("targethost", target.Host)
+	query.Set("targetpath", target.Path)
+	relay.RawQuery = query.Encode()
+
+	t := &odohTransport{targetURL: targetURL, relayURL: relay.String(), events: events}
+	if t.target, err = newHTTPClient(targetURL, newTLSConfig, events); err != nil {
+		return nil, err
+	}
+	if t.relay, err = newHTTPClient(odohRelay, newRelayTLSConfig, events); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// newRelayTLSConfig returns the TLS configuration of the connections to the relay. The relay
+// is verified like the target (-insecure, -tlsCA) and with the same protocol options, but
+// under the name of its URL and without the client certificate of the target.
+func newRelayTLSConfig(address string) *tls.Config {
+	config := newTLSConfig(address)
+	serverName, _, err := net.SplitHostPort(address)
+	if err != nil {
+		serverName = address
+	}
+	config.ServerName = serverName
+	config.Certificates = nil
+	return config
+}
+
+// config returns the configuration of the target, fetching it on first use
+func (t *odohTransport) config() (*odohConfig, error) {
+	return odohConfigs.get(t.targetURL, t.fetchConfig)
+}
+
+// fetchConfig fetches the configuration of the target
+func (t *odohTransport) fetchConfig() (*odohConfig, error) {
+	u, err := url.Parse(t.targetURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path, u.RawQuery = odohConfigsPath, ""
+	resp, err := t.target.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s when fetching the ODoH configs", resp.Status)
+	}
+	return parseODoHConfigs(body)
+}
+
+// send encrypts the message, posts it to the URL and decrypts the response
+func (t *odohTransport) send(client *http.Client, url string, config *odohConfig, packed []byte) (*dns.Msg, error) {
+	encrypted, query, err := config.encryptQuery(packed)
+	if err != nil {
+		return nil, err
+	}
+	body, err := httpPost(client, url, odohContentType, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := config.decryptResponse(query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(dns.Msg)
+	if err = response.Unpack(decrypted); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *odohTransport) exchange(message *dns.Msg) (*dns.Msg, error) {
+	config, err := t.config()
+	if err != nil {
+		return nil, err
+	}
+	packed, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	response, err := t.send(t.relay, t.relayURL, config, packed)
+	if err != nil {
+		return nil, err
+	}
+	viaRelay := time.Since(start)
+
+	t.exchanges++
+	if odohProbe > 0 && t.exchanges%odohProbe == 0 {
+		// Send the same query directly to the target, in the background so that the latency of
+		// the main stream is not affected, to split the latency between relay and target
+		go func() {
+			start := time.Now()
+			if _, err := t.send(t.target, t.targetURL, config, packed); err == nil {
+				t.events.odoh.record(viaRelay, time.Since(start))
+			}
+		}()
+	}
+	return response, nil
+}
+
+func (t *odohTransport) close() {
+	t.relay.CloseIdleConnections()
+	t.target.CloseIdleConnections()
+}
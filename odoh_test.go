@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+)
+
+// Suite of the test configuration: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+var odohTestSuite = hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+
+// testODoHTarget decrypts a query like an ODoH target would, and encrypts the response
+func testODoHTarget(t *testing.T, key kem.PrivateKey, keyID []byte, message []byte, response []byte) []byte {
+	if message[0] != odohMessageQuery {
+		t.Fatalf("Invalid message type %d", message[0])
+	}
+	gotKeyID, rest, err := readPrefixed(message[1:])
+	if err != nil || !bytes.Equal(gotKeyID, keyID) {
+		t.Fatalf("Invalid key ID %x (%v)", gotKeyID, err)
+	}
+	encrypted, _, err := readPrefixed(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// DHKEM(X25519) encapsulated keys are 32 bytes long
+	receiver, err := odohTestSuite.NewReceiver(key, []byte("odoh query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener, err := receiver.Setup(encrypted[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryPlaintext, err := opener.Open(encrypted[32:], appendPrefixed([]byte{odohMessageQuery}, keyID))
+	if err != nil {
+		t.Fatalf("Unable to decrypt the query: %s", err)
+	}
+
+	responseNonce := bytes.Repeat([]byte{0x42}, 16)
+	secret := opener.Export([]byte("odoh response"), 16)
+	prk, _ := hkdf.Extract(sha256.New, secret, appendPrefixed(append([]byte{}, queryPlaintext...), responseNonce))
+	aeadKey, _ := hkdf.Expand(sha256.New, prk, "odoh key", 16)
+	nonce, _ := hkdf.Expand(sha256.New, prk, "odoh nonce", 12)
+	block, _ := aes.NewCipher(aeadKey)
+	aead, _ := cipher.NewGCM(block)
+
+	plaintext := appendPrefixed(appendPrefixed(nil, response), nil)
+	ciphertext := aead.Seal(nil, nonce, plaintext, appendPrefixed([]byte{odohMessageResponse}, responseNonce))
+	return appendPrefixed(appendPrefixed([]byte{odohMessageResponse}, responseNonce), ciphertext)
+}
+
+func TestODoHRoundTrip(t *testing.T) {
+	publicKey, key, err := hpke.KEM_X25519_HKDF_SHA256.Scheme().GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packedKey, err := publicKey.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ObliviousDoHConfigs with a single configuration
+	contents := binary.BigEndian.AppendUint16(nil, uint16(hpke.KEM_X25519_HKDF_SHA256))
+	contents = binary.BigEndian.AppendUint16(contents, uint16(hpke.KDF_HKDF_SHA256))
+	contents = binary.BigEndian.AppendUint16(contents, uint16(hpke.AEAD_AES128GCM))
+	contents = appendPrefixed(contents, packedKey)
+	configs := appendPrefixed(binary.BigEndian.AppendUint16(nil, odohConfigVersion), contents)
+	configs = appendPrefixed(nil, configs)
+
+	config, err := parseODoHConfigs(configs)
+	if err != nil {
+		t.Fatalf("Unable to parse the configs: %s", err)
+	}
+	if len(config.keyID) != sha256.Size {
+		t.Errorf("Invalid key ID length %d", len(config.keyID))
+	}
+
+	query := []byte("query")
+	message, state, err := config.encryptQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedResponse := testODoHTarget(t, key, config.keyID, message, []byte("response"))
+
+	response, err := config.decryptResponse(state, encryptedResponse)
+	if err != nil {
+		t.Fatalf("Unable to decrypt the response: %s", err)
+	}
+	if string(response) != "response" {
+		t.Errorf("Invalid response: got %q", response)
+	}
+
+	// A tampered response must be rejected
+	encryptedResponse[len(encryptedResponse)-1] ^= 0xff
+	if _, err = config.decryptResponse(state, encryptedResponse); err == nil {
+		t.Error("Tampered responses should return a non-nil error")
+	}
+}
+
+func TestParseODoHConfigsUnsupported(t *testing.T) {
+	// A single configuration, with an unknown version
+	configs := appendPrefixed(nil, appendPrefixed([]byte{0xff, 0xff}, []byte{0, 1, 2}))
+	if _, err := parseODoHConfigs(configs); err == nil {
+		t.Error("Unsupported configs should return a non-nil error")
+	}
+}
+
+func TestRelayTLSConfig(t *testing.T) {
+	saved := baseTLSConfig
+	roots := x509.NewCertPool()
+	baseTLSConfig = &tls.Config{ServerName: "resolver.example", InsecureSkipVerify: true, RootCAs: roots, Certificates: []tls.Certificate{{}}}
+	defer func() { baseTLSConfig = saved }()
+
+	if config := newTLSConfig("target.example:443"); config.ServerName != "resolver.example" {
+		t.Errorf("Invalid server name of the target: %q", config.ServerName)
+	}
+	// The relay is verified like the target, but under its own name and without the client
+	// certificate of the target
+	config := newRelayTLSConfig("relay.example:443")
+	if config.ServerName != "relay.example" || len(config.Certificates) != 0 {
+		t.Errorf("The relay should be verified with its own name: %q", config.ServerName)
+	}
+	if !config.InsecureSkipVerify || config.RootCAs != roots {
+		t.Error("The verification options should apply to the relay")
+	}
+}
+
+func TestODoHConfigCache(t *testing.T) {
+	cache := &odohConfigCache{entries: make(map[string]*odohConfigEntry)}
+	var fetches int32
+	slow := make(chan struct{})
+	fetch := func(wait bool, err error) func() (*odohConfig, error) {
+		return func() (*odohConfig, error) {
+			atomic.AddInt32(&fetches, 1)
+			if wait {
+				<-slow
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &odohConfig{}, nil
+		}
+	}
+
+	// The workers of a target wait for a single fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if config, err := cache.get("https://slow.example/dns-query", fetch(true, nil)); err != nil || config == nil {
+				t.Errorf("Invalid configuration of the slow target: %v", err)
+			}
+		}()
+	}
+	// Meanwhile, the configuration of another target is fetched without waiting
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if config, err := cache.get("https://fast.example/dns-query", fetch(false, nil)); err != nil || config == nil {
+			t.Errorf("Invalid configuration of the fast target: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The fetch of a target blocked the other ones")
+	}
+	close(slow)
+	wg.Wait()
+	if fetches != 2 {
+		t.Errorf("Invalid number of fetches: %d, expected 2", fetches)
+	}
+
+	// A failed fetch is tried again, a successful one is kept
+	if _, err := cache.get("https://down.example/dns-query", fetch(false, errors.New("unreachable"))); err == nil {
+		t.Error("The failed fetch should be reported")
+	}
+	cache.get("https://down.example/dns-query", fetch(false, nil))
+	cache.get("https://down.example/dns-query", fetch(false, nil))
+	cache.get("https://fast.example/dns-query", fetch(false, nil))
+	if fetches != 4 {
+		t.Errorf("Invalid number of fetches: %d, expected 4", fetches)
+	}
+}
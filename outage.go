@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/miekg/dns"
+)
+
+// Failures the built-in authoritative server can simulate during an upstream outage
+const (
+	// outageSilent drops the queries without answering
+	outageSilent = "silent"
+	// outageSlow answers the queries after a delay
+	outageSlow = "slow"
+	// outageServFail answers the queries with a SERVFAIL
+	outageServFail = "servfail"
+)
+
+var outageModes = map[string]bool{
+	outageSilent:   true,
+	outageSlow:     true,
+	outageServFail: true,
+}
+
+// Outage options
+var (
+	outageMode     string
+	outageStartMs  int
+	outageLengthMs int
+	outageDelayMs  int
+)
+
+// outageSchedule is the upstream outage simulated by the authoritative server during the run
+type outageSchedule struct {
+	mode  string
+	start time.Time
+	end   time.Time
+	delay time.Duration
+	// TTL of the records of the test zone, after which the answers cached before the outage
+	// expired
+	ttl time.Duration
+
+	mu sync.Mutex
+	// First query answered once the outage is over
+	back time.Time
+}
+
+// newOutageSchedule schedules the outage given on the command line, relative to the start
+// of the run
+func newOutageSchedule(runStart time.Time) *outageSchedule {
+	start := runStart.Add(time.Duration(outageStartMs) * time.Millisecond)
+	return &outageSchedule{
+		mode:  outageMode,
+		start: start,
+		end:   start.Add(time.Duration(outageLengthMs) * time.Millisecond),
+		delay: time.Duration(outageDelayMs) * time.Millisecond,
+		ttl:   time.Duration(authTTL) * time.Second,
+	}
+}
+
+// active tells whether the upstream is failing at the given time
+func (o *outageSchedule) active(now time.Time) bool {
+	return o != nil && !now.Before(o.start) && now.Before(o.end)
+}
+
+// stale tells whether the answers received at the given time can only be stale ones served by
+// the resolver past the expiry of its records: the upstream is failing, and every record
+// cached before the outage expired
+func (o *outageSchedule) stale(now time.Time) bool {
+	return o.active(now) && !now.Before(o.start.Add(o.ttl))
+}
+
+// disrupt applies the outage to a query received by the authoritative server, and tells
+// whether the server should still answer it normally
+func (o *outageSchedule) disrupt(w dns.ResponseWriter, request *dns.Msg) bool {
+	if o == nil {
+		return true
+	}
+	now := time.Now()
+	if !o.active(now) {
+		if !now.Before(o.end) {
+			o.mu.Lock()
+			if o.back.IsZero() {
+				o.back = now
+			}
+			o.mu.Unlock()
+		}
+		return true
+	}
+
+	switch o.mode {
+	case outageSilent:
+		return false
+	case outageServFail:
+		w.WriteMsg(new(dns.Msg).SetRcode(request, dns.RcodeServerFailure))
+		return false
+	}
+	time.Sleep(o.delay)
+	return true
+}
+
+// upstreamBack returns when the authoritative server answered again after the outage, or
+// the zero time if it did not
+func (o *outageSchedule) upstreamBack() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.back
+}
+
+// outageReport follows the outage from one interval of the stats to the next
+type outageReport struct {
+	started bool
+	ended   bool
+}
+
+// check prints a notice when the outage starts or ends
+func (r *outageReport) check(o *outageSchedule, now time.Time) {
+	if !r.started && !now.Before(o.start) {
+		r.started = true
+		fmt.Println(aurora.Yellow(fmt.Sprintf("Upstream outage started (%s)", o.mode)))
+	}
+	if !r.ended && !now.Before(o.end) {
+		r.ended = true
+		fmt.Println(aurora.Yellow("Upstream outage over"))
+	}
+}
+
+// printOutageSummary prints how the resolver coped with the outage
+func printOutageSummary(s runSummary, o *outageSchedule) {
+	fmt.Printf(
+		"  Upstream outage (%s, %s): %d stale answers, %d SERVFAIL\n",
+		o.mode,
+		o.end.Sub(o.start),
+		s.Stale,
+		s.ServFail,
+	)
+	if back := o.upstreamBack(); !back.IsZero() {
+		fmt.Printf("  Recovery: upstream queried again %s after the outage", back.Sub(o.end).Round(time.Millisecond))
+		if s.Recovery > 0 {
+			fmt.Printf(", last failure %s after it", s.Recovery.Round(time.Millisecond))
+		} else {
+			fmt.Print(", no failure after it")
+		}
+		fmt.Print("\n")
+	}
+}
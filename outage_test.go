@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestOutageSchedule(t *testing.T) {
+	server := newTestAuthServer(t)
+	name := server.names[5]
+
+	for _, mode := range []string{outageSilent, outageServFail, outageSlow} {
+		now := time.Now()
+		server.outage = &outageSchedule{mode: mode, start: now.Add(-time.Second), end: now.Add(time.Second), delay: 10 * time.Millisecond}
+		if !server.outage.active(now) || server.outage.active(now.Add(-2*time.Second)) || server.outage.active(now.Add(time.Second)) {
+			t.Errorf("Invalid %s outage window", mode)
+		}
+
+		start := time.Now()
+		response := exchangeAuth(server, name, dns.TypeA)
+		switch {
+		case mode == outageSilent && response != nil:
+			t.Errorf("No answer expected during a silent outage: %s", response)
+		case mode == outageServFail && (response == nil || response.Rcode != dns.RcodeServerFailure):
+			t.Errorf("SERVFAIL expected during a servfail outage: %s", response)
+		case mode == outageSlow && (response == nil || len(response.Answer) == 0 || time.Since(start) < 10*time.Millisecond):
+			t.Errorf("Delayed answer expected during a slow outage: %s", response)
+		}
+		if !server.outage.upstreamBack().IsZero() {
+			t.Error("The upstream should not be back during the outage")
+		}
+	}
+
+	server.outage.end = time.Now()
+	if response := exchangeAuth(server, name, dns.TypeA); response == nil || len(response.Answer) == 0 {
+		t.Errorf("Answer expected after the outage: %s", response)
+	}
+	if server.outage.upstreamBack().IsZero() {
+		t.Error("The upstream should be back after the outage")
+	}
+}
+
+func TestOutageStale(t *testing.T) {
+	now := time.Now()
+	outage := &outageSchedule{start: now, end: now.Add(time.Minute), ttl: 10 * time.Second}
+	// The records cached just before the outage are still fresh
+	if outage.stale(now.Add(5 * time.Second)) {
+		t.Error("The answers should not be stale before the TTL expired")
+	}
+	if !outage.stale(now.Add(10*time.Second)) || !outage.stale(now.Add(30*time.Second)) {
+		t.Error("The answers should be stale once the TTL expired during the outage")
+	}
+	if outage.stale(now.Add(time.Minute)) || (*outageSchedule)(nil).stale(now) {
+		t.Error("The answers should not be stale without an outage")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Path to the Starlark script with the hooks building the queries and inspecting the responses
+var scriptPath string
+
+// Maximum number of Starlark computation steps of a single hook call, so that a script stuck
+// in a loop fails instead of stopping a worker
+const scriptMaxSteps = 1000000
+
+// Key of the counters of a worker, in the thread-local values of its Starlark thread
+const scriptCountersKey = "counters"
+
+// queryScript holds the hooks defined by the script, shared by all the workers. The globals
+// of the script are frozen once it is loaded, so that the hooks can run concurrently.
+type queryScript struct {
+	// query(worker, n) returns the n-th query of a worker, or None to send the usual one
+	query starlark.Callable
+	// response(query, response) inspects a response, and returns False when it is invalid
+	response starlark.Callable
+	// Counters added by the script while it was loaded, counted in the first interval
+	counters map[string]int
+}
+
+// script is the loaded script, when there is one
+var script *queryScript
+
+// loadScript runs the script, and returns its hooks
+func loadScript(path string) (*queryScript, error) {
+	thread := &starlark.Thread{Name: "load", Print: scriptPrint}
+	thread.SetLocal(scriptCountersKey, make(map[string]int))
+	predeclared := starlark.StringDict{"count": starlark.NewBuiltin("count", scriptCount)}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{While: true, Set: true}, thread, path, nil, predeclared)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	globals.Freeze()
+
+	s := &queryScript{counters: thread.Local(scriptCountersKey).(map[string]int)}
+	hooks := map[string]*starlark.Callable{"query": &s.query, "response": &s.response}
+	for name, hook := range hooks {
+		value, ok := globals[name]
+		if !ok {
+			continue
+		}
+		if *hook, ok = value.(starlark.Callable); !ok {
+			return nil, fmt.Errorf("%s is not a function", name)
+		}
+	}
+	if s.query == nil && s.response == nil {
+		return nil, fmt.Errorf("the script defines neither a query nor a response function")
+	}
+	return s, nil
+}
+
+// scriptCount is the count(name, n=1) builtin, adding n to a custom counter of the stats
+func scriptCount(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	n := 1
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "n?", &n); err != nil {
+		return nil, err
+	}
+	thread.Local(scriptCountersKey).(map[string]int)[name] += n
+	return starlark.None, nil
+}
+
+// scriptPrint prints the messages of the print builtin
+func scriptPrint(thread *starlark.Thread, msg string) {
+	fmt.Println(msg)
+}
+
+// scriptError adds the Starlark backtrace to the errors of the script
+func scriptError(err error) error {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return fmt.Errorf("%s", evalErr.Backtrace())
+	}
+	return err
+}
+
+// scriptRunner runs the hooks of the script for a worker
+type scriptRunner struct {
+	script *queryScript
+	thread *starlark.Thread
+	worker int
+	// Number of queries built by the query hook
+	built int
+}
+
+func newScriptRunner(s *queryScript, worker int) *scriptRunner {
+	thread := &starlark.Thread{Name: fmt.Sprintf("worker %d", worker), Print: scriptPrint}
+	thread.SetLocal(scriptCountersKey, make(map[string]int))
+	return &scriptRunner{script: s, thread: thread, worker: worker}
+}
+
+// call calls a hook, within the limit of steps
+func (r *scriptRunner) call(hook starlark.Callable, args ...starlark.Value) (starlark.Value, error) {
+	r.thread.SetMaxExecutionSteps(r.thread.ExecutionSteps() + scriptMaxSteps)
+	value, err := starlark.Call(r.thread, hook, args, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	return value, nil
+}
+
+// query returns the next query built by the script, or nil to send the usual one
+func (r *scriptRunner) query() (*dns.Msg, error) {
+	if r.script.query == nil {
+		return nil, nil
+	}
+	value, err := r.call(r.script.query, starlark.MakeInt(r.worker), starlark.MakeInt(r.built))
+	if err != nil {
+		return nil, err
+	}
+	r.built++
+	if value == starlark.None {
+		return nil, nil
+	}
+
+	// A name, a (name, type) tuple, or a dict with the name, type, rd and do keys
+	fields := map[string]starlark.Value{}
+	switch v := value.(type) {
+	case starlark.String:
+		fields["name"] = v
+	case starlark.Tuple:
+		if len(v) != 2 {
+			return nil, fmt.Errorf("query returned a tuple of %d items, expected (name, type)", len(v))
+		}
+		fields["name"], fields["type"] = v[0], v[1]
+	case *starlark.Dict:
+		for _, item := range v.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("query returned a dict with a non-string key %s", item[0])
+			}
+			fields[key] = item[1]
+		}
+	default:
+		return nil, fmt.Errorf("query returned a %s, expected a name, a (name, type) tuple or a dict", value.Type())
+	}
+
+	name, ok := starlark.AsString(fields["name"])
+	if !ok || name == "" {
+		return nil, fmt.Errorf("query returned no name")
+	}
+	qtype := dns.TypeA
+	if value, ok := fields["type"]; ok {
+		typeName, _ := starlark.AsString(value)
+		if qtype, ok = dns.StringToType[strings.ToUpper(typeName)]; !ok {
+			return nil, fmt.Errorf("query returned an unknown type %s", value)
+		}
+	}
+	message := new(dns.Msg).SetQuestion(dns.Fqdn(name), qtype)
+	message.RecursionDesired = !iterative
+	if value, ok := fields["rd"]; ok {
+		message.RecursionDesired = bool(value.Truth())
+	}
+	if value, ok := fields["do"]; ok && bool(value.Truth()) {
+		message.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return message, nil
+}
+
+// response passes the response, or the error, to the script, and tells whether the script
+// considers it valid
+func (r *scriptRunner) response(message *dns.Msg, response *dns.Msg, err error, spent time.Duration) (bool, error) {
+	if r.script.response == nil {
+		return true, nil
+	}
+	question := message.Question[0]
+	query := starlark.NewDict(2)
+	query.SetKey(starlark.String("name"), starlark.String(question.Name))
+	query.SetKey(starlark.String("type"), starlark.String(typeName(question.Qtype)))
+
+	result := starlark.NewDict(8)
+	result.SetKey(starlark.String("latency"), starlark.Float(float64(spent)/float64(time.Millisecond)))
+	if err != nil {
+		result.SetKey(starlark.String("error"), starlark.String(err.Error()))
+	} else {
+		result.SetKey(starlark.String("error"), starlark.None)
+		result.SetKey(starlark.String("rcode"), starlark.String(dns.RcodeToString[response.Rcode]))
+		result.SetKey(starlark.String("aa"), starlark.Bool(response.Authoritative))
+		result.SetKey(starlark.String("tc"), starlark.Bool(response.Truncated))
+		result.SetKey(starlark.String("ad"), starlark.Bool(response.AuthenticatedData))
+		for key, section := range map[string][]dns.RR{"answer": response.Answer, "authority": response.Ns, "additional": response.Extra} {
+			records := make([]starlark.Value, 0, len(section))
+			for _, rr := range section {
+				records = append(records, starlark.String(rr.String()))
+			}
+			result.SetKey(starlark.String(key), starlark.NewList(records))
+		}
+	}
+
+	value, err := r.call(r.script.response, query, result)
+	if err != nil {
+		return false, err
+	}
+	return value != starlark.False, nil
+}
+
+// take returns the counters of the script since the last call
+func (r *scriptRunner) take() map[string]int {
+	counters := r.thread.Local(scriptCountersKey).(map[string]int)
+	if len(counters) == 0 {
+		return nil
+	}
+	r.thread.SetLocal(scriptCountersKey, make(map[string]int))
+	return counters
+}
+
+// formatCounters returns the counters, sorted by name
+func formatCounters(counters map[string]int) string {
+	var names []string
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%d", name, counters[name])
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeScript writes the source of a script in a temporary file, and returns its path
+func writeScript(t *testing.T, source string) string {
+	path := filepath.Join(t.TempDir(), "hooks.star")
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatalf("Unable to write the script: %s", err)
+	}
+	return path
+}
+
+func TestScriptQuery(t *testing.T) {
+	path := writeScript(t, `
+def query(worker, n):
+    if n == 0:
+        return "n%d.example.com" % worker
+    if n == 1:
+        return ("example.com", "mx")
+    if n == 2:
+        return {"name": "example.org.", "type": "AAAA", "rd": False, "do": True}
+    return None
+`)
+	s, err := loadScript(path)
+	if err != nil {
+		t.Fatalf("Unable to load the script: %s", err)
+	}
+	runner := newScriptRunner(s, 3)
+
+	expected := []dns.Question{
+		{Name: "n3.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+		{Name: "example.org.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+	}
+	for _, question := range expected {
+		message, err := runner.query()
+		if err != nil {
+			t.Fatalf("Unable to build the query: %s", err)
+		}
+		if message == nil || message.Question[0] != question {
+			t.Fatalf("Invalid query: %v, expected %v", message, question)
+		}
+	}
+	if message, _ := runner.query(); message != nil {
+		t.Errorf("Returning None should send the usual query, got %v", message)
+	}
+
+	path = writeScript(t, `
+def query(worker, n):
+    return ("example.com", "BAD")
+`)
+	if s, err = loadScript(path); err != nil {
+		t.Fatalf("Unable to load the script: %s", err)
+	}
+	if _, err = newScriptRunner(s, 0).query(); err == nil {
+		t.Error("Unknown query types should return a non-nil error")
+	}
+}
+
+func TestScriptResponse(t *testing.T) {
+	path := writeScript(t, `
+def response(query, response):
+    if response["error"]:
+        count("timeouts")
+        return
+    count("answers", len(response["answer"]))
+    if response["rcode"] != "NOERROR" or not response["answer"]:
+        count("invalid")
+        return False
+    return True
+`)
+	s, err := loadScript(path)
+	if err != nil {
+		t.Fatalf("Unable to load the script: %s", err)
+	}
+	runner := newScriptRunner(s, 0)
+
+	message := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	answer := new(dns.Msg).SetReply(message)
+	rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	answer.Answer = append(answer.Answer, rr, rr)
+	if valid, err := runner.response(message, answer, nil, time.Millisecond); err != nil || !valid {
+		t.Errorf("The answer should be valid: %t (%v)", valid, err)
+	}
+	empty := new(dns.Msg).SetRcode(message, dns.RcodeNameError)
+	if valid, err := runner.response(message, empty, nil, time.Millisecond); err != nil || valid {
+		t.Errorf("The NXDOMAIN answer should be invalid: %t (%v)", valid, err)
+	}
+	if valid, err := runner.response(message, nil, errors.New("i/o timeout"), time.Second); err != nil || !valid {
+		t.Errorf("Returning None should keep the response valid: %t (%v)", valid, err)
+	}
+
+	counters := runner.take()
+	if counters["answers"] != 2 || counters["invalid"] != 1 || counters["timeouts"] != 1 {
+		t.Errorf("Invalid counters: %v", counters)
+	}
+	if counters = runner.take(); counters != nil {
+		t.Errorf("The counters should be reset once taken: %v", counters)
+	}
+	if formatted := formatCounters(map[string]int{"b": 2, "a": 1}); formatted != "a=1 b=2" {
+		t.Errorf("Invalid formatted counters: %s", formatted)
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	if _, err := loadScript(writeScript(t, "x = 1\n")); err == nil {
+		t.Error("Scripts without hooks should return a non-nil error")
+	}
+	if _, err := loadScript(writeScript(t, "query = 1\n")); err == nil {
+		t.Error("Hooks that are not functions should return a non-nil error")
+	}
+	if _, err := loadScript(writeScript(t, "load('other.star', 'x')\n")); err == nil {
+		t.Error("Scripts should not be able to load other files")
+	}
+
+	s, err := loadScript(writeScript(t, `
+def query(worker, n):
+    while True:
+        pass
+`))
+	if err != nil {
+		t.Fatalf("Unable to load the script: %s", err)
+	}
+	if _, err = newScriptRunner(s, 0).query(); err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("Endless hooks should be stopped: %v", err)
+	}
+}
+
+func TestScriptCounters(t *testing.T) {
+	path := writeScript(t, `
+count("loaded", 2)
+
+def query(worker, n):
+    count("queries")
+    return None
+`)
+	s, err := loadScript(path)
+	if err != nil {
+		t.Fatalf("Unable to load the script: %s", err)
+	}
+	if s.counters["loaded"] != 2 {
+		t.Errorf("The counters of the loading should be kept: %v", s.counters)
+	}
+
+	// The counters taken from the worker, in flooding mode too, add up in its stats
+	runner := newScriptRunner(s, 0)
+	var stats workerStats
+	for i := 0; i < 3; i++ {
+		runner.query()
+		stats.count(runner.take())
+	}
+	if stats.counters["queries"] != 3 || len(stats.counters) != 1 {
+		t.Errorf("Invalid counters of the worker: %v", stats.counters)
+	}
+	if counters := runner.take(); counters != nil {
+		t.Errorf("The counters should be reset once taken: %v", counters)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// workerStats holds the stats of the queries of a worker during an interval
+type workerStats struct {
+	sent       int
+	err        int
+	nxdomain   int
+	servfail   int
+	elapsed    time.Duration
+	maxElapsed time.Duration
+	// Latency of the requests, when waiting for the answers
+	latencies latencyHistogram
+	// Stats of each transport, with a transport mix
+	transports []transportStats
+
+	// Answers received during the upstream outage, and time of the last failure since it
+	// started
+	stale       int
+	lastFailure time.Time
+
+	// How the worker coped with the connection disruptions of the chaos module
+	recovered       int
+	lost            int
+	recoveryTime    time.Duration
+	maxRecoveryTime time.Duration
+
+	// TLS handshakes, full or resumed, and the time they took
+	handshakes       int
+	resumed          int
+	handshakeTime    time.Duration
+	maxHandshakeTime time.Duration
+
+	// ODoH queries sent both through the relay and directly to the target
+	odohSamples  int
+	odohViaRelay time.Duration
+	odohDirect   time.Duration
+
+	// Custom counters of the script
+	counters map[string]int
+
+	// Queries sent for each type and name pattern, with the authoritative test server
+	amplification map[amplificationKey]int
+}
+
+// add sums the stats of another worker
+func (s *workerStats) add(other *workerStats) {
+	s.sent += other.sent
+	s.err += other.err
+	s.nxdomain += other.nxdomain
+	s.servfail += other.servfail
+	s.elapsed += other.elapsed
+	if other.maxElapsed > s.maxElapsed {
+		s.maxElapsed = other.maxElapsed
+	}
+	s.latencies.merge(&other.latencies)
+	if s.transports == nil && other.transports != nil {
+		s.transports = make([]transportStats, len(other.transports))
+	}
+	for i := range other.transports {
+		s.transports[i].add(&other.transports[i])
+	}
+	s.stale += other.stale
+	if other.lastFailure.After(s.lastFailure) {
+		s.lastFailure = other.lastFailure
+	}
+	s.recovered += other.recovered
+	s.lost += other.lost
+	s.recoveryTime += other.recoveryTime
+	if other.maxRecoveryTime > s.maxRecoveryTime {
+		s.maxRecoveryTime = other.maxRecoveryTime
+	}
+	s.handshakes += other.handshakes
+	s.resumed += other.resumed
+	s.handshakeTime += other.handshakeTime
+	if other.maxHandshakeTime > s.maxHandshakeTime {
+		s.maxHandshakeTime = other.maxHandshakeTime
+	}
+	s.odohSamples += other.odohSamples
+	s.odohViaRelay += other.odohViaRelay
+	s.odohDirect += other.odohDirect
+	s.count(other.counters)
+	for key, n := range other.amplification {
+		if s.amplification == nil {
+			s.amplification = make(map[amplificationKey]int)
+		}
+		s.amplification[key] += n
+	}
+}
+
+// amplified counts a query sent for the type and name pattern of the key
+func (s *workerStats) amplified(key amplificationKey) {
+	if s.amplification == nil {
+		s.amplification = make(map[amplificationKey]int)
+	}
+	s.amplification[key]++
+}
+
+// count adds to the custom counters of the script
+func (s *workerStats) count(counters map[string]int) {
+	for name, n := range counters {
+		if s.counters == nil {
+			s.counters = make(map[string]int)
+		}
+		s.counters[name] += n
+	}
+}
+
+// reset clears the stats, keeping the transports of the mix and the map of the queries of
+// each pattern
+func (s *workerStats) reset() {
+	transports := s.transports
+	for i := range transports {
+		transports[i] = transportStats{}
+	}
+	amplification := s.amplification
+	clear(amplification)
+	*s = workerStats{transports: transports, amplification: amplification}
+}
+
+// newWorkerStats returns empty stats, with a transport mix of the given size
+func newWorkerStats(mix int) workerStats {
+	s := workerStats{}
+	if mix > 1 {
+		s.transports = make([]transportStats, mix)
+	}
+	return s
+}
+
+// intervalIndex returns the number of the interval of the given length in which t is,
+// counted from the Unix epoch, so that the intervals of every run are aligned on the wall
+// clock
+func intervalIndex(t time.Time, length time.Duration) int64 {
+	return t.UnixNano() / int64(length)
+}
+
+// intervalStart returns the start of the numbered interval
+func intervalStart(index int64, length time.Duration) time.Time {
+	return time.Unix(0, index*int64(length))
+}
+
+// Number of intervals of a shard: the interval being taken by the reporter, and the two next
+// ones in which the workers may write meanwhile
+const shardBuffers = 3
+
+// statsShard holds the stats of a single worker, so that the workers never wait for each
+// other or for the reporter. Each query is counted in the interval in which it completed:
+// the worker writes in the buffer of that interval, and the reporter resets the buffers it
+// took for the intervals to come.
+type statsShard struct {
+	length  time.Duration
+	buffers [shardBuffers]workerStats
+	// Last interval taken by the reporter
+	taken atomic.Int64
+	// Set while the worker writes, so that the reporter waits before reading the buffer of
+	// the interval it took
+	writing atomic.Bool
+}
+
+func newStatsShard(mix int, length time.Duration, first int64) *statsShard {
+	s := &statsShard{length: length}
+	for i := range s.buffers {
+		s.buffers[i] = newWorkerStats(mix)
+	}
+	s.taken.Store(first - 1)
+	return s
+}
+
+// begin returns the stats of the interval in which a query completed at the given time, that
+// the worker may update until it calls end. The queries completed in an interval that was
+// already taken by the reporter are counted in the next one, and those completed further
+// ahead are counted in the last interval the worker may write in, until the reporter
+// catches up.
+func (s *statsShard) begin(completed time.Time) *workerStats {
+	s.writing.Store(true)
+	index := intervalIndex(completed, s.length)
+	taken := s.taken.Load()
+	if index <= taken {
+		index = taken + 1
+	} else if index > taken+2 {
+		index = taken + 2
+	}
+	return &s.buffers[index%shardBuffers]
+}
+
+// end tells the reporter that the worker is done updating its stats
+func (s *statsShard) end() {
+	s.writing.Store(false)
+}
+
+// takeInto adds the stats of the worker during the interval following the last one taken
+// to total, and resets them. It must only be called by the reporter.
+func (s *statsShard) takeInto(total *workerStats) {
+	index := s.taken.Add(1)
+	// The worker either saw the interval was taken, or is still writing in its buffer
+	for s.writing.Load() {
+		runtime.Gosched()
+	}
+	total.add(&s.buffers[index%shardBuffers])
+	s.buffers[index%shardBuffers].reset()
+}
+
+// statsShards holds the stats of all the workers
+type statsShards struct {
+	length time.Duration
+	// Next interval to take
+	next   int64
+	shards []*statsShard
+}
+
+// newStatsShards returns the shards of the workers, with intervals of the given length
+// starting from the current one
+func newStatsShards(workers, mix int, length time.Duration) *statsShards {
+	first := intervalIndex(time.Now(), length)
+	s := &statsShards{length: length, next: first, shards: make([]*statsShard, workers)}
+	for i := range s.shards {
+		s.shards[i] = newStatsShard(mix, length, first)
+	}
+	return s
+}
+
+// take returns the stats of all the workers for the queries completed before end, since the
+// last call
+func (s *statsShards) take(end time.Time) workerStats {
+	var total workerStats
+	last := intervalIndex(end.Add(-1), s.length)
+	for ; s.next <= last; s.next++ {
+		for _, shard := range s.shards {
+			shard.takeInto(&total)
+		}
+	}
+	return total
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsShards(t *testing.T) {
+	const workers, queries = 8, 20000
+	const length = time.Millisecond
+	shards := newStatsShards(workers, 2, length)
+	key := amplificationKey{qtype: 1, pattern: "*.stress.test."}
+
+	var wg sync.WaitGroup
+	for _, shard := range shards.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < queries; i++ {
+				stats := shard.begin(time.Now())
+				stats.sent++
+				stats.latencies.record(time.Millisecond)
+				stats.transports[i%2].record(time.Millisecond, i%10 == 0)
+				stats.amplified(key)
+				shard.end()
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Take the stats while the workers update them, then once they are done
+	var total workerStats
+	for taking := true; taking; {
+		select {
+		case <-done:
+			taking = false
+		default:
+		}
+		taken := shards.take(time.Now())
+		total.add(&taken)
+	}
+	taken := shards.take(time.Now().Add(10 * length))
+	total.add(&taken)
+
+	if total.sent != workers*queries || total.latencies.total != workers*queries {
+		t.Errorf("Invalid total: %d queries, %d latencies, expected %d", total.sent, total.latencies.total, workers*queries)
+	}
+	if mix := total.transports; mix[0].sent != workers*queries/2 || mix[0].err != workers*queries/10 || mix[1].err != 0 {
+		t.Errorf("Invalid transports: %d queries, %d and %d errors", mix[0].sent, mix[0].err, mix[1].err)
+	}
+	if total.amplification[key] != workers*queries {
+		t.Errorf("Invalid queries of the pattern: %d, expected %d", total.amplification[key], workers*queries)
+	}
+	if taken := shards.take(time.Now().Add(20 * length)); taken.sent != 0 || taken.latencies.total != 0 || len(taken.amplification) != 0 {
+		t.Errorf("The stats should be reset once taken: %d queries", taken.sent)
+	}
+}
+
+func TestStatsShardsIntervals(t *testing.T) {
+	const length = time.Second
+	shards := newStatsShards(1, 1, length)
+	shard := shards.shards[0]
+	start := intervalStart(shards.next, length)
+
+	record := func(completed time.Time) {
+		shard.begin(completed).sent++
+		shard.end()
+	}
+	record(start.Add(100 * time.Millisecond))
+	record(start.Add(1500 * time.Millisecond))
+	// Too far ahead: counted in the next interval until the first one is taken
+	record(start.Add(5 * time.Second))
+
+	if taken := shards.take(start.Add(length)); taken.sent != 1 {
+		t.Errorf("Invalid first interval: %d queries, expected 1", taken.sent)
+	}
+	// Completed in the first interval, but after it was taken
+	record(start.Add(900 * time.Millisecond))
+	if taken := shards.take(start.Add(length)); taken.sent != 0 {
+		t.Errorf("The first interval should only be taken once: %d queries", taken.sent)
+	}
+	if taken := shards.take(start.Add(2 * length)); taken.sent != 3 {
+		t.Errorf("Invalid second interval: %d queries, expected 3", taken.sent)
+	}
+
+	if index := intervalIndex(start.Add(length-1), length); intervalStart(index, length) != start {
+		t.Errorf("Invalid start of interval %d: %s, expected %s", index, intervalStart(index, length), start)
+	}
+}
@@ -15,37 +15,368 @@ func round(val float64) int {
 	return int(val + 0.5)
 }
 
+// statsMessage carries the events of the routines other than the workers, whose stats are
+// taken from their shards at the end of each interval
 type statsMessage struct {
-	sent       int
-	err        int
-	flush      bool
-	elapsed    time.Duration
-	maxElapsed time.Duration
+	// The interval ending at end is over: displayStats displays its stats
+	flush bool
+	end   time.Time
+	// The run is over: displayStats returns its summary
+	stop bool
+
+	// Connection disruptions injected by the chaos module
+	disruptions int
+
+	// Connections held open by the connection capacity test
+	heldOpened  int
+	heldFailed  int
+	heldDropped int
+	heldError   error
+
+	// Round of the thundering herd test
+	herd *herdRound
+
+	// Result of a canary query
+	canary *canaryProbe
+}
+
+// runSummary sums up the results of a whole run
+type runSummary struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Sent     int           `json:"sent"`
+	Received int           `json:"received"`
+	Errors   int           `json:"errors"`
+	Mean     time.Duration `json:"mean"`
+	P50      time.Duration `json:"p50"`
+	P99      time.Duration `json:"p99"`
+	Max      time.Duration `json:"max"`
+	// Replies with a NXDOMAIN code, and queries received by the built-in authoritative server
+	NXDomain int `json:"nxdomain,omitempty"`
+	Upstream int `json:"upstream,omitempty"`
+	ServFail int `json:"servfail,omitempty"`
+	// Stale answers received during the upstream outage, and time from its end to the last
+	// failure
+	Stale    int           `json:"stale,omitempty"`
+	Recovery time.Duration `json:"recovery,omitempty"`
+	// Upstream queries received for the client queries, by type and name pattern
+	Amplification []amplificationStats `json:"amplification,omitempty"`
+	// Rounds of the thundering herd test
+	Herd *herdSummary `json:"herd,omitempty"`
+	// Outages detected from the reply rate and the errors
+	Downtime *downtimeSummary `json:"downtime,omitempty"`
+	// Custom counters of the script
+	Counters map[string]int `json:"counters,omitempty"`
+	// Throughput sustained by the adaptive rate
+	Adaptive *adaptiveSummary `json:"adaptive,omitempty"`
+	// Queries of the canary, apart from the load of the workers
+	Canary *canarySummary `json:"canary,omitempty"`
+	// Packets lost by the network impairment
+	Impairment *impairmentSummary `json:"impairment,omitempty"`
+	// Summary of each transport, with a transport mix
+	Transports map[string]runSummary `json:"transports,omitempty"`
+}
+
+// qps returns the rate of replies received during the run
+func (s runSummary) qps() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Received) / s.Duration.Seconds()
+}
+
+func printSummary(s runSummary) {
+	fmt.Printf(
+		"\n%s %d requests in %s, %d replies (%.0fr/s)",
+		aurora.Bold("Summary:"),
+		s.Sent,
+		s.Duration.Round(time.Millisecond),
+		s.Received,
+		s.qps(),
+	)
+	if s.P99 > 0 {
+		fmt.Printf(
+			" (mean=%.1fms / p50=%.1fms / p99=%.1fms / max=%.1fms)",
+			1000.*s.Mean.Seconds(),
+			1000.*s.P50.Seconds(),
+			1000.*s.P99.Seconds(),
+			1000.*s.Max.Seconds(),
+		)
+	}
+	if s.Errors > 0 {
+		fmt.Printf("\t %s", aurora.Red(fmt.Sprintf("Errors: %d", s.Errors)))
+	}
+	fmt.Print("\n")
+
+	if nxdomainZone != "" && s.Received > 0 {
+		fmt.Printf("  NXDOMAIN: %d replies (%d%%)\n", s.NXDomain, 100*s.NXDomain/s.Received)
+	}
+	if authoritative != nil {
+		fmt.Printf("  Upstream: %d queries received by the authoritative server", s.Upstream)
+		if s.Sent > 0 {
+			fmt.Printf(" (%.3f per request)", float64(s.Upstream)/float64(s.Sent))
+		}
+		fmt.Print("\n")
+	}
+	if s.Downtime != nil {
+		printDowntimeSummary(s.Downtime)
+	}
+	if authoritative != nil && authoritative.outage != nil {
+		printOutageSummary(s, authoritative.outage)
+	}
+	if s.Herd != nil {
+		printHerdSummary(s.Herd)
+	}
+	if s.Adaptive != nil {
+		printAdaptiveSummary(s.Adaptive)
+	}
+	if s.Canary != nil {
+		printCanarySummary(s.Canary)
+	}
+	if s.Impairment != nil {
+		printImpairmentSummary(s.Impairment)
+	}
+	printAmplification(s.Amplification)
+	if len(s.Counters) > 0 {
+		fmt.Printf("  Script: %s\n", formatCounters(s.Counters))
+	}
+
+	for _, share := range transportMix {
+		t, ok := s.Transports[share.name]
+		if !ok {
+			continue
+		}
+		fmt.Printf(
+			"  %-12s %d requests, %d replies (%.0fr/s) (mean=%.1fms / p50=%.1fms / p99=%.1fms / max=%.1fms)",
+			share.name,
+			t.Sent,
+			t.Received,
+			t.qps(),
+			1000.*t.Mean.Seconds(),
+			1000.*t.P50.Seconds(),
+			1000.*t.P99.Seconds(),
+			1000.*t.Max.Seconds(),
+		)
+		if t.Errors > 0 {
+			fmt.Printf("\t %s", aurora.Red(fmt.Sprintf("Errors: %d", t.Errors)))
+		}
+		fmt.Print("\n")
+	}
+}
+
+// transportSummary returns the summary of the queries sent with a transport of the mix
+func transportSummary(start time.Time, total *transportStats) runSummary {
+	summary := runSummary{
+		Start:    start,
+		Duration: time.Since(start),
+		Sent:     total.sent,
+		Received: total.sent - total.err,
+		Errors:   total.err,
+		P50:      total.latencies.percentile(50),
+		P99:      total.latencies.percentile(99),
+		Max:      total.maxElapsed,
+	}
+	if total.sent > 0 {
+		summary.Mean = total.elapsed / time.Duration(total.sent)
+	}
+	return summary
 }
 
-func displayStats(channel chan statsMessage) {
+// displayStats displays the stats of the workers and the events sent by the other routines
+// until the run is stopped, and returns its summary
+func displayStats(channel chan statsMessage, shards *statsShards) runSummary {
 	// Displays every N seconds the number of sent requests, and the rate
 	start := time.Now()
+	runStart := start
+	var totalElapsed time.Duration
+	var totalMaxElapsed time.Duration
+	var latencies latencyHistogram
+	var intervalLatencies latencyHistogram
+	// Stats of each transport of the mix, during the interval and in total
+	mixStats := make([]transportStats, len(transportMix))
+	mixTotals := make([]transportStats, len(transportMix))
 	sent := 0
 	var elapsed time.Duration
 	var maxElapsed time.Duration
 	errors := 0
+	nxdomain := 0
+	totalNXDomain := 0
+	totalUpstream := 0
+	servfail := 0
+	totalServFail := 0
+	stale := 0
+	totalStale := 0
+	var lastFailure time.Time
+	var outage outageReport
+	var herd herdSummary
+	var downtime downtimeDetector
+	var herdLatencies latencyHistogram
+	var canary canaryStats
+	var totalCanary canaryStats
+	counters := make(map[string]int)
+	totalCounters := make(map[string]int)
+	if script != nil {
+		// Counted by the script while it was loaded
+		for name, n := range script.counters {
+			counters[name] += n
+			totalCounters[name] += n
+		}
+	}
+	disruptions := 0
+	recovered := 0
+	lost := 0
+	var recoveryTime time.Duration
+	var maxRecoveryTime time.Duration
+	handshakes := 0
+	resumed := 0
+	var handshakeTime time.Duration
+	var maxHandshakeTime time.Duration
+	odohSamples := 0
+	var odohViaRelay time.Duration
+	var odohDirect time.Duration
+	held := 0
+	heldOpened := 0
+	heldFailed := 0
+	heldDropped := 0
+	var heldError error
+	capacity := capacityReport{}
 	totalSent := 0
 	totalReceived := 0
 	for {
 		// Read the channel and add the number of sent messages
 		added := <-channel
-		sent += added.sent
-		errors += added.err
-		elapsed += added.elapsed
-		if added.maxElapsed > maxElapsed {
-			maxElapsed = added.maxElapsed
+		disruptions += added.disruptions
+		held += added.heldOpened - added.heldDropped
+		heldOpened += added.heldOpened
+		heldFailed += added.heldFailed
+		heldDropped += added.heldDropped
+		if heldError == nil {
+			heldError = added.heldError
+		}
+		if added.herd != nil {
+			herd.record(added.herd)
+			herdLatencies.merge(&added.herd.latencies)
+			printHerdRound(herd.Rounds, added.herd)
+		}
+		if added.canary != nil {
+			canary.record(added.canary)
+			totalCanary.record(added.canary)
+		}
+
+		end := added.end
+		if added.stop {
+			end = time.Now()
+		}
+		if added.flush || added.stop {
+			// Take the stats of the queries completed during the interval
+			workers := shards.take(end)
+			sent += workers.sent
+			errors += workers.err
+			nxdomain += workers.nxdomain
+			servfail += workers.servfail
+			stale += workers.stale
+			if workers.lastFailure.After(lastFailure) {
+				lastFailure = workers.lastFailure
+			}
+			elapsed += workers.elapsed
+			if workers.maxElapsed > maxElapsed {
+				maxElapsed = workers.maxElapsed
+			}
+			totalElapsed += workers.elapsed
+			if workers.maxElapsed > totalMaxElapsed {
+				totalMaxElapsed = workers.maxElapsed
+			}
+			latencies.merge(&workers.latencies)
+			intervalLatencies.merge(&workers.latencies)
+			for i := range workers.transports {
+				mixStats[i].add(&workers.transports[i])
+				mixTotals[i].add(&workers.transports[i])
+			}
+			recovered += workers.recovered
+			lost += workers.lost
+			recoveryTime += workers.recoveryTime
+			if workers.maxRecoveryTime > maxRecoveryTime {
+				maxRecoveryTime = workers.maxRecoveryTime
+			}
+			handshakes += workers.handshakes
+			resumed += workers.resumed
+			handshakeTime += workers.handshakeTime
+			if workers.maxHandshakeTime > maxHandshakeTime {
+				maxHandshakeTime = workers.maxHandshakeTime
+			}
+			odohSamples += workers.odohSamples
+			odohViaRelay += workers.odohViaRelay
+			odohDirect += workers.odohDirect
+			for name, n := range workers.counters {
+				counters[name] += n
+				totalCounters[name] += n
+			}
+			if authoritative != nil {
+				authoritative.amplification.add(workers.amplification)
+			}
+		}
+
+		if added.stop {
+			summary := runSummary{
+				Start:    runStart,
+				Duration: end.Sub(runStart),
+				Sent:     totalSent + sent,
+				Received: totalReceived + sent - errors,
+				P50:      latencies.percentile(50),
+				P99:      latencies.percentile(99),
+				Max:      totalMaxElapsed,
+			}
+			summary.Errors = summary.Sent - summary.Received
+			summary.Downtime = downtime.summary(time.Now())
+			summary.NXDomain = totalNXDomain + nxdomain
+			summary.Upstream = totalUpstream
+			summary.ServFail = totalServFail + servfail
+			summary.Stale = totalStale + stale
+			if len(totalCounters) > 0 {
+				summary.Counters = totalCounters
+			}
+			if authoritative != nil {
+				summary.Upstream += authoritative.queries.take()
+				summary.Amplification = authoritative.amplification.stats()
+				if o := authoritative.outage; o != nil && lastFailure.After(o.end) {
+					summary.Recovery = lastFailure.Sub(o.end)
+				}
+			}
+			if adaptive != nil {
+				summary.Adaptive = adaptive.summary(end)
+			}
+			if canaryFile != "" {
+				summary.Canary = totalCanary.summary()
+			}
+			if impairing() {
+				summary.Impairment = takeImpairmentSummary()
+			}
+			if herdSize > 0 {
+				herd.P50 = herdLatencies.percentile(50)
+				herd.P99 = herdLatencies.percentile(99)
+				summary.Herd = &herd
+			}
+			if latencies.total > 0 {
+				summary.Mean = totalElapsed / time.Duration(latencies.total)
+			}
+			if len(transportMix) > 1 {
+				summary.Transports = make(map[string]runSummary)
+				for i, share := range transportMix {
+					summary.Transports[share.name] = transportSummary(runStart, &mixTotals[i])
+				}
+			}
+			return summary
 		}
 
 		if added.flush == true {
 			// Something has asked for a display flush
 
-			elapsedSeconds := time.Since(start).Seconds()
+			elapsedSeconds := end.Sub(start).Seconds()
+
+			fmt.Print(aurora.Faint(end.Format(intervalTimeFormat())), " ")
+			if length := end.Sub(start); length != time.Duration(displayInterval)*time.Millisecond {
+				fmt.Print(aurora.Faint(fmt.Sprintf("(%s) ", length.Round(time.Millisecond))))
+			}
 
 			if sent > 0 {
 				fmt.Printf(
@@ -80,24 +411,238 @@ func displayStats(channel chan statsMessage) {
 				fmt.Printf("No requests were sent %s", aurora.Sprintf(aurora.Faint("(total responses received: %d)"), totalReceived))
 			}
 
+			if servfail > 0 {
+				fmt.Printf("\t%s", aurora.Red(fmt.Sprintf("SERVFAIL: %d", servfail)))
+			}
+
+			if stale > 0 {
+				fmt.Printf("\t%s %d", aurora.Faint("Stale answers:"), stale)
+			}
+
+			if nxdomainZone != "" && sent > errors {
+				fmt.Printf("\t%s %3d%%", aurora.Faint("NXDOMAIN:"), 100*nxdomain/(sent-errors))
+			}
+
+			if authoritative != nil {
+				upstream := authoritative.queries.take()
+				totalUpstream += upstream
+				fmt.Printf("\t%s %6.dq/s", aurora.Faint("Upstream:"), round(float64(upstream)/elapsedSeconds))
+				if sent > 0 {
+					fmt.Printf(" (%.3f per request)", float64(upstream)/float64(sent))
+				}
+			}
+
+			if disruptions > 0 || recovered > 0 || lost > 0 {
+				fmt.Printf(
+					"\t%s %d disrupted, %d recovered",
+					aurora.Faint("Chaos:"),
+					disruptions,
+					recovered,
+				)
+				if recovered > 0 {
+					fmt.Printf(
+						" (mean=%.0fms / max=%.0fms)",
+						1000.*recoveryTime.Seconds()/float64(recovered),
+						1000.*maxRecoveryTime.Seconds(),
+					)
+				}
+				if lost > 0 {
+					fmt.Printf(", %s", aurora.Red(fmt.Sprintf("%d lost", lost)))
+				}
+			}
+
+			if handshakes > 0 || resumed > 0 {
+				fmt.Printf(
+					"\t%s %6.dh/s (%d full / %d resumed, mean=%.0fms / max=%.0fms)",
+					aurora.Faint("TLS handshakes:"),
+					round(float64(handshakes+resumed)/elapsedSeconds),
+					handshakes,
+					resumed,
+					1000.*handshakeTime.Seconds()/float64(handshakes+resumed),
+					1000.*maxHandshakeTime.Seconds(),
+				)
+			}
+
+			if odohSamples > 0 {
+				// The relay adds what the sampled queries did not spend when sent directly
+				target := odohDirect.Seconds() / float64(odohSamples)
+				relay := odohViaRelay.Seconds()/float64(odohSamples) - target
+				if relay < 0 {
+					relay = 0
+				}
+				fmt.Printf(
+					"\t%s relay=%.0fms / target=%.0fms",
+					aurora.Faint("ODoH latency:"),
+					1000.*relay,
+					1000.*target,
+				)
+			}
+
+			if holdTarget > 0 {
+				fmt.Printf(
+					"\t%s %d (+%d opened",
+					aurora.Faint("Held connections:"),
+					held,
+					heldOpened,
+				)
+				if heldFailed > 0 {
+					fmt.Printf(", %s", aurora.Red(fmt.Sprintf("%d failed", heldFailed)))
+				}
+				if heldDropped > 0 {
+					fmt.Printf(", %s", aurora.Red(fmt.Sprintf("%d dropped", heldDropped)))
+				}
+				fmt.Print(")")
+			}
+
+			if canary.probes > 0 {
+				fmt.Printf(
+					"\t%s p50=%.0fms / max=%.0fms",
+					aurora.Faint("Canary:"),
+					1000.*canary.latencies.percentile(50).Seconds(),
+					1000.*canary.max.Seconds(),
+				)
+				if canary.failures > 0 {
+					fmt.Printf(", %s", aurora.Red(fmt.Sprintf("%d/%d failed", canary.failures, canary.probes)))
+				}
+				canary = canaryStats{}
+			}
+
+			var sustained *adaptivePeriod
+			if adaptive != nil {
+				var rate float64
+				rate, sustained = adaptive.update(start, end, sent, sent-errors, intervalLatencies.percentile(99))
+				fmt.Printf("\t%s %6.dq/s", aurora.Faint("Next rate:"), round(rate))
+			}
+
+			intervalCounters := counters
+			if len(counters) > 0 {
+				fmt.Printf("\t%s %s", aurora.Faint("Script:"), formatCounters(counters))
+				counters = make(map[string]int)
+			}
+
 			fmt.Print("\n")
 
-			start = time.Now()
+			if len(transportMix) > 1 {
+				for i, share := range transportMix {
+					stats := mixStats[i]
+					if stats.sent == 0 {
+						continue
+					}
+					fmt.Printf(
+						"  %-12s %6dr/s (mean=%.0fms / max=%.0fms)",
+						share.name,
+						round(float64(stats.sent-stats.err)/elapsedSeconds),
+						1000.*stats.elapsed.Seconds()/float64(stats.sent),
+						1000.*stats.maxElapsed.Seconds(),
+					)
+					if stats.err > 0 {
+						fmt.Printf("\t %s", aurora.Red(fmt.Sprintf("Errors: %d (%d%%)", stats.err, 100*stats.err/stats.sent)))
+					}
+					fmt.Print("\n")
+					mixStats[i] = transportStats{}
+				}
+			}
+
+			if sustained != nil {
+				printAdaptivePeriod(adaptive.target, sustained)
+			}
+
+			if authoritative != nil && authoritative.outage != nil {
+				outage.check(authoritative.outage, time.Now())
+			}
+			if pacing.take() {
+				// A lower rate or a pause is not an outage
+				downtime.rebase()
+			} else {
+				downtime.check(start, end, sent, errors+servfail)
+			}
+
+			if web != nil {
+				rate, paused := pacing.state()
+				web.publish(intervalSample{
+					Time:     end,
+					Length:   elapsedSeconds,
+					Sent:     sent,
+					Received: sent - errors,
+					Errors:   errors,
+					ServFail: servfail,
+					P50:      1000. * intervalLatencies.percentile(50).Seconds(),
+					P99:      1000. * intervalLatencies.percentile(99).Seconds(),
+					Max:      1000. * maxElapsed.Seconds(),
+					Rate:     rate,
+					Paused:   paused,
+					Counters: intervalCounters,
+				})
+			}
+
+			if holdTarget > 0 {
+				var mean time.Duration
+				if sent > errors {
+					mean = elapsed / time.Duration(sent)
+				}
+				capacity.check(held, heldError, mean)
+			}
+
+			start = end
+			intervalLatencies = latencyHistogram{}
 			totalSent += sent
 			totalReceived += sent - errors
+			totalNXDomain += nxdomain
+			totalServFail += servfail
+			totalStale += stale
 			sent = 0
 			errors = 0
+			nxdomain = 0
+			servfail = 0
+			stale = 0
 			elapsed = 0
 			maxElapsed = 0
+			disruptions = 0
+			recovered = 0
+			lost = 0
+			recoveryTime = 0
+			maxRecoveryTime = 0
+			handshakes = 0
+			resumed = 0
+			handshakeTime = 0
+			maxHandshakeTime = 0
+			odohSamples = 0
+			odohViaRelay = 0
+			odohDirect = 0
+			heldOpened = 0
+			heldFailed = 0
+			heldDropped = 0
+			heldError = nil
 		}
 	}
 }
 
+// intervalTimeFormat returns the format of the end of the intervals, with milliseconds
+// when they do not last whole seconds
+func intervalTimeFormat() string {
+	if displayInterval%1000 != 0 {
+		return "15:04:05.000"
+	}
+	return "15:04:05"
+}
+
+// Time waited after the end of an interval before taking its stats, so that the queries
+// completed right before its end are counted in it
+const statsFlushDelay = 10 * time.Millisecond
+
+// timerStats triggers a display update at the end of each interval. The intervals are aligned
+// on the wall clock rather than on the start of the run, so that the intervals of runs from
+// several hosts line up.
 func timerStats(channel chan<- statsMessage) {
-	// Periodically triggers a display update for the stats
-	for {
-		timer := time.NewTimer(time.Duration(displayInterval) * time.Millisecond)
-		<-timer.C
-		channel <- statsMessage{flush: true}
+	length := time.Duration(displayInterval) * time.Millisecond
+	now := time.Now()
+	end := intervalStart(intervalIndex(now, length)+1, length)
+	if end.Sub(now) < length/2 {
+		// Merge a short first interval with the next one
+		end = end.Add(length)
+	}
+	for ; ; end = end.Add(length) {
+		time.Sleep(time.Until(end.Add(statsFlushDelay)))
+		channel <- statsMessage{flush: true, end: end}
 	}
 }
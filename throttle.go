@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum rate of the queries sent by all the workers together, 0 for no limit
+var rateLimit float64
+
+// throttle paces the queries of all the workers to a rate, and pauses them, as set with
+// -rate and from the dashboard
+type throttle struct {
+	// Whether the queries are paced or paused, read before taking the lock so that the
+	// workers are not slowed down without limit
+	active atomic.Bool
+
+	mu     sync.Mutex
+	rate   float64
+	paused bool
+	// Closed when the queries are resumed
+	resume chan struct{}
+	// Instant from which the next query may be sent
+	next time.Time
+	// Whether the rate or the pause changed since the last call to take
+	changed bool
+}
+
+// pacing paces the queries of the workers
+var pacing = &throttle{}
+
+// wait blocks until the next query may be sent
+func (t *throttle) wait() {
+	if !t.active.Load() {
+		return
+	}
+	t.mu.Lock()
+	for t.paused {
+		resume := t.resume
+		t.mu.Unlock()
+		<-resume
+		t.mu.Lock()
+	}
+	if t.rate <= 0 {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	at := t.next
+	t.next = t.next.Add(time.Duration(float64(time.Second) / t.rate))
+	t.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// setRate sets the rate of the queries, 0 for no limit
+func (t *throttle) setRate(rate float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	t.changed = t.changed || rate != t.rate
+	t.rate = rate
+	t.next = time.Time{}
+	t.active.Store(t.paused || t.rate > 0)
+}
+
+// adjust sets the rate of the queries like setRate, but as a small correction that does not
+// count as a change, e.g. from the adaptive rate
+func (t *throttle) adjust(rate float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate = rate
+	t.active.Store(t.paused || t.rate > 0)
+}
+
+// setPaused pauses or resumes the queries
+func (t *throttle) setPaused(paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if paused == t.paused {
+		return
+	}
+	t.changed = true
+	t.paused = paused
+	if paused {
+		t.resume = make(chan struct{})
+	} else {
+		close(t.resume)
+	}
+	t.active.Store(t.paused || t.rate > 0)
+}
+
+// state returns the rate of the queries and whether they are paused
+func (t *throttle) state() (rate float64, paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rate, t.paused
+}
+
+// take tells whether the rate was changed or the queries paused since the last call
+func (t *throttle) take() (changed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed = t.changed || t.paused
+	t.changed = false
+	return
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottleRate(t *testing.T) {
+	th := &throttle{}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		th.wait()
+	}
+	if time.Since(start) > 10*time.Millisecond {
+		t.Errorf("Queries without limit should not wait: %s", time.Since(start))
+	}
+
+	th.setRate(200)
+	start = time.Now()
+	for i := 0; i < 21; i++ {
+		th.wait()
+	}
+	// The first query is sent right away, the next ones every 5ms
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 150*time.Millisecond {
+		t.Errorf("21 queries at 200q/s took %s instead of 100ms", elapsed)
+	}
+	if !th.take() || th.take() {
+		t.Error("Changing the rate should be reported once")
+	}
+}
+
+func TestThrottlePause(t *testing.T) {
+	th := &throttle{}
+	th.setPaused(true)
+	sent := make(chan struct{})
+	go func() {
+		th.wait()
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("Paused queries should wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if !th.take() || !th.take() {
+		t.Error("Intervals should be reported as changed while paused")
+	}
+
+	th.setPaused(false)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Resumed queries should be sent")
+	}
+	if rate, paused := th.state(); rate != 0 || paused {
+		t.Errorf("Invalid state: rate=%f paused=%t", rate, paused)
+	}
+}
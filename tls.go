@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS options, for the dot and doh transports
+var (
+	insecure        bool
+	tlsCert         string
+	tlsKey          string
+	tlsCA           string
+	tlsServerName   string
+	tlsMinVersion   string
+	tlsMaxVersion   string
+	tlsCiphers      string
+	tlsCurves       string
+	tlsALPN         string
+	tlsNoResumption bool
+)
+
+// baseTLSConfig is built from the TLS options, and cloned for each connection
+var baseTLSConfig = &tls.Config{}
+
+// Mapping of TLS versions to their crypto/tls representation
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Mapping of key exchange groups to their crypto/tls representation
+var tlsCurveIDs = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// loadTLSConfig builds baseTLSConfig from the TLS options
+func loadTLSConfig() error {
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+		ServerName:         tlsServerName,
+	}
+
+	if tlsCert != "" || tlsKey != "" {
+		// Client certificate, for mutual TLS
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return fmt.Errorf("unable to load the client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsCA != "" {
+		pem, err := os.ReadFile(tlsCA)
+		if err != nil {
+			return fmt.Errorf("unable to read the CA file: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in the CA file %s", tlsCA)
+		}
+	}
+
+	var err error
+	if tlsMinVersion != "" {
+		if config.MinVersion, err = parseTLSVersion(tlsMinVersion); err != nil {
+			return err
+		}
+	}
+	if tlsMaxVersion != "" {
+		if config.MaxVersion, err = parseTLSVersion(tlsMaxVersion); err != nil {
+			return err
+		}
+	}
+	if tlsCiphers != "" {
+		if config.CipherSuites, err = parseCipherSuites(tlsCiphers); err != nil {
+			return err
+		}
+	}
+	if tlsCurves != "" {
+		if config.CurvePreferences, err = parseCurves(tlsCurves); err != nil {
+			return err
+		}
+	}
+	if tlsALPN != "" {
+		config.NextProtos = splitList(tlsALPN)
+	}
+
+	baseTLSConfig = config
+	return nil
+}
+
+// parseTLSVersion returns the TLS version matching its name (e.g. "1.2")
+func parseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", name)
+	}
+	return version, nil
+}
+
+// parseCipherSuites returns the IDs of a comma-separated list of cipher suite names
+func parseCipherSuites(list string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range splitList(list) {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseCurves returns the IDs of a comma-separated list of key exchange groups
+func parseCurves(list string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range splitList(list) {
+		id, ok := tlsCurveIDs[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// splitList splits a comma-separated list, ignoring blanks
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// handshakeCounter counts the TLS handshakes made by a transport, and the time they took
+type handshakeCounter struct {
+	mu         sync.Mutex
+	full       int
+	resumed    int
+	elapsed    time.Duration
+	maxElapsed time.Duration
+}
+
+// record adds a completed handshake to the counter
+func (h *handshakeCounter) record(state tls.ConnectionState, spent time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state.DidResume {
+		h.resumed++
+	} else {
+		h.full++
+	}
+	h.elapsed += spent
+	if spent > h.maxElapsed {
+		h.maxElapsed = spent
+	}
+}
+
+// take returns the handshakes recorded since the last call
+func (h *handshakeCounter) take() (full int, resumed int, elapsed time.Duration, maxElapsed time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	full, resumed, elapsed, maxElapsed = h.full, h.resumed, h.elapsed, h.maxElapsed
+	h.full, h.resumed, h.elapsed, h.maxElapsed = 0, 0, 0, 0
+	return
+}
+
+// newTLSConfig returns the TLS configuration used by a transport to connect to the given
+// address. Each transport gets its own session cache, like independent clients would.
+func newTLSConfig(address string) *tls.Config {
+	config := baseTLSConfig.Clone()
+	if config.ServerName == "" {
+		serverName, _, err := net.SplitHostPort(address)
+		if err != nil {
+			serverName = address
+		}
+		config.ServerName = serverName
+	}
+	if !tlsNoResumption {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+	return config
+}
+
+// dialTLS opens a connection to the resolver and performs the TLS handshake
+func dialTLS(address string, config *tls.Config, events *transportEvents) (*tls.Conn, error) {
+	conn, err := dialStream(address, events)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(start.Add(exchangeTimeout))
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	events.handshakes.record(tlsConn.ConnectionState(), time.Since(start))
+	return tlsConn, nil
+}
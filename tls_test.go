@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := parseTLSVersion("1.2")
+	if err != nil || version != tls.VersionTLS12 {
+		t.Errorf("Invalid parsing of TLS version 1.2: got %d (%v)", version, err)
+	}
+
+	if _, err = parseTLSVersion("1.4"); err == nil {
+		t.Error("Unknown TLS versions should return a non-nil error")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	if len(ids) != len(expected) || ids[0] != expected[0] || ids[1] != expected[1] {
+		t.Errorf("Invalid parsing of cipher suites: got %v but expected %v", ids, expected)
+	}
+
+	if _, err = parseCipherSuites("TLS_NOT_A_CIPHER"); err == nil {
+		t.Error("Unknown cipher suites should return a non-nil error")
+	}
+}
+
+func TestParseCurves(t *testing.T) {
+	ids, err := parseCurves("x25519,P256")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(ids) != 2 || ids[0] != tls.X25519 || ids[1] != tls.CurveP256 {
+		t.Errorf("Invalid parsing of curves: got %v", ids)
+	}
+
+	if _, err = parseCurves("P128"); err == nil {
+		t.Error("Unknown curves should return a non-nil error")
+	}
+}
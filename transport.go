@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Supported transports
+const (
+	transportUDP  = "udp"
+	transportTCP  = "tcp"
+	transportDoT  = "dot"
+	transportDoH  = "doh"
+	transportODoH = "odoh"
+	// DNSCrypt v2, over UDP or TCP
+	transportDNSCrypt    = "dnscrypt"
+	transportDNSCryptTCP = "dnscrypt-tcp"
+)
+
+// HTTP versions of the doh transport
+const (
+	dohHTTP1 = "1.1"
+	dohHTTP2 = "2"
+	dohHTTP3 = "3"
+)
+
+// Default port of the resolver for each transport, when none is given
+var transportPorts = map[string]string{
+	transportUDP:         "53",
+	transportTCP:         "53",
+	transportDoT:         "853",
+	transportDoH:         "443",
+	transportODoH:        "443",
+	transportDNSCrypt:    "443",
+	transportDNSCryptTCP: "443",
+}
+
+// exchangeTimeout is the maximum time spent waiting for a connection or an answer
+const exchangeTimeout = 2 * time.Second
+
+// transport sends DNS messages to the resolver. Each worker owns its own transport, so
+// implementations do not need to be safe for concurrent use.
+type transport interface {
+	// exchange sends the message and waits for the answer
+	exchange(message *dns.Msg) (*dns.Msg, error)
+	// close releases the connection held by the transport, if any
+	close()
+}
+
+// isStreamTransport tells whether the transport keeps long-lived connections to the resolver
+func isStreamTransport(name string) bool {
+	return name == transportTCP || name == transportDoT || name == transportDoH || name == transportODoH ||
+		name == transportDNSCryptTCP
+}
+
+// isHTTPTransport tells whether the transport sends the messages over HTTP
+func isHTTPTransport(name string) bool {
+	return name == transportDoH || name == transportODoH
+}
+
+// transportEvents is shared by a worker and its transport, to report what happens on the
+// connections besides the answers themselves.
+type transportEvents struct {
+	// disruptions injected by the chaos module
+	disruptions disruptionTracker
+	// TLS handshakes
+	handshakes handshakeCounter
+	// latency split between the ODoH relay and target
+	odoh odohCounter
+	// number of connections opened to the resolver, updated atomically
+	connections int32
+}
+
+// newTransport returns a transport of the given kind, sending messages to address, and
+// recording its connection events in events.
+func newTransport(name, address string, events *transportEvents) (transport, error) {
+	switch name {
+	case transportUDP:
+		return &udpTransport{address: address}, nil
+	case transportTCP:
+		return &streamTransport{address: address, events: events}, nil
+	case transportDoT:
+		return &streamTransport{address: address, events: events, tlsConfig: newTLSConfig(address)}, nil
+	case transportDoH:
+		return newDoHTransport(address, events)
+	case transportODoH:
+		return newODoHTransport(address, events)
+	case transportDNSCrypt:
+		return newDNSCryptTransport(address, false, events)
+	case transportDNSCryptTCP:
+		return newDNSCryptTransport(address, true, events)
+	}
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
+
+// resolverAddress normalizes the resolver given on the command line for the transport
+func resolverAddress(name, input string) (string, error) {
+	if isHTTPTransport(name) && strings.HasPrefix(input, "https://") {
+		// Full URL of the DoH endpoint
+		return input, nil
+	}
+	port, ok := transportPorts[name]
+	if !ok {
+		return input, fmt.Errorf("unknown transport %q", name)
+	}
+	address, err := ParseIPPortWithDefault(input, port)
+	if err != nil {
+		return input, err
+	}
+	if isHTTPTransport(name) {
+		return "https://" + address + "/dns-query", nil
+	}
+	return address, nil
+}
+
+// dialStream opens a TCP connection to the resolver, that the chaos module may disrupt and
+// the network impairment may affect
+func dialStream(address string, events *transportEvents) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, exchangeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&events.connections, 1)
+	if chaosMode != "" {
+		conn = newChaosConn(conn, &events.disruptions)
+	}
+	if impairing() {
+		conn = newImpairedConn(conn, false)
+	}
+	return conn, nil
+}
+
+// dialDatagram opens a UDP socket to the resolver, that the network impairment may affect
+func dialDatagram(address string) (net.Conn, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if impairing() {
+		return impairedPacketConn{newImpairedConn(conn, true)}, nil
+	}
+	return conn, nil
+}
+
+// udpTransport sends each message from a new UDP socket, or from a single one while the
+// network is impaired, so that the datagrams it holds back may be overtaken by the next ones.
+// In flooding mode, the messages are sent concurrently, each from its own socket.
+type udpTransport struct {
+	address string
+	conn    *dns.Conn
+}
+
+func (t *udpTransport) exchange(message *dns.Msg) (*dns.Msg, error) {
+	if impairing() && !flood {
+		return t.exchangeShared(message)
+	}
+	//XXX: How can we share the connection between subsequent attempts ?
+	dnsconn, err := dialDatagram(t.address)
+	if err != nil {
+		return nil, err
+	}
+	co := &dns.Conn{Conn: dnsconn}
+	defer co.Close()
+	co.SetDeadline(time.Now().Add(exchangeTimeout))
+
+	// Actually send the message and wait for answer
+	co.WriteMsg(message)
+
+	return co.ReadMsg()
+}
+
+// exchangeShared sends the message from the socket of the transport, opening it first if
+// needed, and skips the late answers to the previous messages
+func (t *udpTransport) exchangeShared(message *dns.Msg) (*dns.Msg, error) {
+	if t.conn == nil {
+		conn, err := dialDatagram(t.address)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = &dns.Conn{Conn: conn}
+	}
+
+	t.conn.SetDeadline(time.Now().Add(exchangeTimeout))
+	if err := t.conn.WriteMsg(message); err != nil {
+		t.close()
+		return nil, err
+	}
+	for {
+		response, err := t.conn.ReadMsg()
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+			t.close()
+		}
+		if err != nil || isAnswer(response, message) {
+			return response, err
+		}
+	}
+}
+
+// isAnswer tells whether the response answers the message, rather than a previous one
+func isAnswer(response *dns.Msg, message *dns.Msg) bool {
+	if response.Id != message.Id || len(response.Question) != len(message.Question) {
+		return false
+	}
+	for i, q := range response.Question {
+		m := message.Question[i]
+		if q.Qtype != m.Qtype || q.Qclass != m.Qclass || !strings.EqualFold(q.Name, m.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *udpTransport) close() {
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// streamTransport sends messages over a persistent TCP connection, wrapped in TLS for DoT.
+// The connection is dropped after any error, and opened again on the next exchange.
+type streamTransport struct {
+	address   string
+	tlsConfig *tls.Config
+	events    *transportEvents
+	conn      *dns.Conn
+}
+
+func (t *streamTransport) connect() error {
+	var conn net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		conn, err = dialTLS(t.address, t.tlsConfig, t.events)
+	} else {
+		conn, err = dialStream(t.address, t.events)
+	}
+	if err != nil {
+		return err
+	}
+	t.conn = &dns.Conn{Conn: conn}
+	return nil
+}
+
+func (t *streamTransport) exchange(message *dns.Msg) (*dns.Msg, error) {
+	reused := t.conn != nil
+	response, err := t.send(message)
+	if ne, ok := err.(net.Error); err != nil && reused && !(ok && ne.Timeout()) {
+		// The resolver may have closed the connection while it was idle: try again on a new one
+		response, err = t.send(message)
+	}
+	return response, err
+}
+
+// send writes the message on the connection, opening it first if needed, and reads the answer
+func (t *streamTransport) send(message *dns.Msg) (*dns.Msg, error) {
+	if t.conn == nil {
+		if err := t.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	t.conn.SetDeadline(time.Now().Add(exchangeTimeout))
+	err := t.conn.WriteMsg(message)
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	response, err := t.conn.ReadMsg()
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *streamTransport) close() {
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// dohTransport sends messages as HTTP POST requests (RFC 8484)
+type dohTransport struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHTransport(endpoint string, events *transportEvents) (*dohTransport, error) {
+	client, err := newHTTPClient(endpoint, newTLSConfig, events)
+	if err != nil {
+		return nil, err
+	}
+	return &dohTransport{url: endpoint, client: client}, nil
+}
+
+// newHTTPClient returns an HTTP client dedicated to a worker, hence with its own connection to
+// the server of the endpoint, using the HTTP version selected for DoH and the TLS configuration
+// returned by newConfig for the address of the server
+func newHTTPClient(endpoint string, newConfig func(address string) *tls.Config, events *transportEvents) (*http.Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), transportPorts[transportDoH])
+	}
+
+	tlsConfig := newConfig(address)
+	var roundTripper http.RoundTripper
+	switch dohVersion {
+	case dohHTTP1:
+		if len(tlsConfig.NextProtos) == 0 {
+			tlsConfig.NextProtos = []string{"http/1.1"}
+		}
+		roundTripper = &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialTLS(address, tlsConfig, events)
+			},
+			// A non-nil empty map disables HTTP/2
+			TLSNextProto:        make(map[string]func(string, *tls.Conn) http.RoundTripper),
+			MaxIdleConnsPerHost: 1,
+		}
+	case dohHTTP2:
+		if len(tlsConfig.NextProtos) == 0 {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		roundTripper = &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialTLS(address, tlsConfig, events)
+			},
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 1,
+		}
+	case dohHTTP3:
+		// The ALPN protocol is always set to h3 by quic-go
+		roundTripper = &http3.Transport{
+			TLSClientConfig: tlsConfig,
+			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+				return dialQUIC(ctx, address, tlsCfg, cfg, events)
+			},
+		}
+	default:
+		return nil, fmt.Errorf("unknown HTTP version %q", dohVersion)
+	}
+
+	return &http.Client{
+		Transport: roundTripper,
+		Timeout:   exchangeTimeout,
+	}, nil
+}
+
+// dialQUIC opens a QUIC connection to the resolver, for DoH over HTTP/3
+func dialQUIC(ctx context.Context, address string, tlsConfig *tls.Config, config *quic.Config, events *transportEvents) (*quic.Conn, error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, address, tlsConfig, config)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&events.connections, 1)
+	events.handshakes.record(conn.ConnectionState().TLS, time.Since(start))
+	return conn, nil
+}
+
+func (t *dohTransport) exchange(message *dns.Msg) (*dns.Msg, error) {
+	packed, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	body, err := httpPost(t.client, t.url, "application/dns-message", packed)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(dns.Msg)
+	if err = response.Unpack(body); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// httpPost sends the payload to the URL, and returns the body of the response
+func httpPost(client *http.Client, url string, contentType string, payload []byte) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("Accept", contentType)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return body, nil
+}
+
+func (t *dohTransport) close() {
+	t.client.CloseIdleConnections()
+}
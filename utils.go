@@ -1,15 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"net"
+	"strings"
+
+	"github.com/miekg/dns"
 )
 
 // ParseIPPort returns a valid string that can be passed to net.Dial, containing both the IP
 // address and the port number.
 func ParseIPPort(input string) (string, error) {
+	return ParseIPPortWithDefault(input, "53")
+}
+
+// ParseIPPortWithDefault works like ParseIPPort, using the given port number when the input
+// does not specify one.
+func ParseIPPortWithDefault(input string, defaultPort string) (string, error) {
 	if ip := net.ParseIP(input); ip != nil {
 		// A "pure" IP was passed, with no port number (or name)
-		return net.JoinHostPort(ip.String(), "53"), nil
+		return net.JoinHostPort(ip.String(), defaultPort), nil
 	}
 	// Input has both address and port
 	host, port, err := net.SplitHostPort(input)
@@ -18,3 +30,58 @@ func ParseIPPort(input string) (string, error) {
 	}
 	return net.JoinHostPort(host, port), nil
 }
+
+// readQueries reads a list of DNS requests in the format of -dataFile: a domain name and a
+// query type per line. Blank lines and comments starting with # or ; are ignored.
+func readQueries(r io.Reader) ([]query, error) {
+	var queries []query
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		q, ok, err := parseQuery(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if ok {
+			queries = append(queries, q)
+		}
+	}
+	return queries, scanner.Err()
+}
+
+// parseQuery parses a line in the format of -dataFile, and tells whether it holds a query
+func parseQuery(line string) (query, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+		return query{}, false, nil
+	}
+	// Columns after the query type are ignored
+	if len(fields) < 2 {
+		return query{}, false, fmt.Errorf("expected '<domain name> <query type>'")
+	}
+	recordType, ok := dns.StringToType[strings.ToUpper(fields[1])]
+	if !ok {
+		return query{}, false, fmt.Errorf("unknown query type %q", fields[1])
+	}
+	return query{domain: dns.Fqdn(fields[0]), recordType: recordType}, true, nil
+}
+
+// writeQueries writes a list of DNS requests in the format read by readQueries
+func writeQueries(w io.Writer, queries []query) error {
+	buffered := bufio.NewWriter(w)
+	for _, q := range queries {
+		if _, err := fmt.Fprintf(buffered, "%s\t%s\n", q.domain, typeName(q.recordType)); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// typeName returns the name of a query type
+func typeName(recordType uint16) string {
+	if name, ok := dns.TypeToString[recordType]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", recordType)
+}
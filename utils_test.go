@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
 
 func TestParseIPPort(t *testing.T) {
 	tables := []struct {
@@ -31,3 +38,53 @@ func TestParseIPPort(t *testing.T) {
 		t.Error("Invalid inputs should return a non-nil error")
 	}
 }
+
+func TestParseIPPortWithDefault(t *testing.T) {
+	tables := []struct {
+		input    string
+		port     string
+		expected string
+	}{
+		{"127.0.0.1", "853", "127.0.0.1:853"},
+		{"127.0.0.1:53", "853", "127.0.0.1:53"},
+		{"2001:4b98:dc2:45:216:3eff:fe4b:8c5b", "443", "[2001:4b98:dc2:45:216:3eff:fe4b:8c5b]:443"},
+	}
+
+	for _, table := range tables {
+		result, _ := ParseIPPortWithDefault(table.input, table.port)
+		if result != table.expected {
+			t.Errorf("Invalid parsing of input %s: got %s but expected %s", table.input, result, table.expected)
+		}
+	}
+}
+
+func TestReadQueries(t *testing.T) {
+	input := "www.example.com.\tA\n\n# comment\n; comment\nexample.org mx 42 extra\nlast.example.net. AAAA"
+	queries, err := readQueries(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Unable to read the queries: %s", err)
+	}
+	expected := []query{
+		{"www.example.com.", dns.TypeA},
+		{"example.org.", dns.TypeMX},
+		{"last.example.net.", dns.TypeAAAA},
+	}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Errorf("Invalid queries: got %v, expected %v", queries, expected)
+	}
+
+	var output bytes.Buffer
+	if err = writeQueries(&output, queries); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "www.example.com.\tA\nexample.org.\tMX\nlast.example.net.\tAAAA\n" {
+		t.Errorf("Invalid output: got %q", output.String())
+	}
+
+	// Invalid input
+	for _, input := range []string{"example.com.", "example.com. NOTATYPE"} {
+		if _, err = readQueries(strings.NewReader(input)); err == nil {
+			t.Errorf("Invalid input %q should return a non-nil error", input)
+		}
+	}
+}
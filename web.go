@@ -0,0 +1,220 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Address on which the dashboard is served, empty to disable it
+var webAddress string
+
+// Number of intervals sent to a dashboard when it connects, so that its charts do not start
+// empty
+const webBacklog = 300
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// intervalSample holds the stats of an interval, as streamed to the dashboards
+type intervalSample struct {
+	Time time.Time `json:"time"`
+	// Length of the interval, in seconds
+	Length   float64 `json:"length"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Errors   int     `json:"errors"`
+	ServFail int     `json:"servfail"`
+	// Latency percentiles of the interval, in milliseconds
+	P50 float64 `json:"p50"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+	// Rate limit of the queries (0 for none), and whether they are paused
+	Rate     float64        `json:"rate"`
+	Paused   bool           `json:"paused"`
+	Counters map[string]int `json:"counters,omitempty"`
+}
+
+// dashboard streams the stats of the intervals to the browsers connected to it
+type dashboard struct {
+	mu sync.Mutex
+	// Last intervals, encoded in JSON
+	samples [][]byte
+	clients map[chan []byte]struct{}
+	// Host name of the listen address, the only name besides localhost under which the
+	// dashboard is served
+	host string
+}
+
+// web is the dashboard, when there is one
+var web *dashboard
+
+func newDashboard(address string) *dashboard {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return &dashboard{clients: make(map[chan []byte]struct{}), host: host}
+}
+
+// startDashboard serves the dashboard on the address
+func startDashboard(address string) (*dashboard, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	d := newDashboard(address)
+	go http.Serve(listener, d.handler())
+	return d, nil
+}
+
+// publish sends the stats of an interval to the connected browsers. The browsers that are
+// too slow to keep up miss the interval.
+func (d *dashboard) publish(sample intervalSample) {
+	encoded, _ := json.Marshal(sample)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.samples = append(d.samples, encoded)
+	if len(d.samples) > webBacklog {
+		d.samples = d.samples[len(d.samples)-webBacklog:]
+	}
+	for client := range d.clients {
+		select {
+		case client <- encoded:
+		default:
+		}
+	}
+}
+
+// subscribe returns the last intervals, and a channel receiving the next ones
+func (d *dashboard) subscribe() ([][]byte, chan []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	client := make(chan []byte, 16)
+	d.clients[client] = struct{}{}
+	return append([][]byte(nil), d.samples...), client
+}
+
+func (d *dashboard) unsubscribe(client chan []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.clients, client)
+}
+
+func (d *dashboard) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+	mux.HandleFunc("/events", d.serveEvents)
+	mux.HandleFunc("/control", serveControl)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !d.allowedHost(r.Host) {
+			http.Error(w, "unknown host", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost tells whether the dashboard is served under the host of a request. Another
+// page of the browser may point its own name to the dashboard address (DNS rebinding) so as
+// to pass for the same origin: only IP addresses, localhost and the name of the listen address
+// are accepted.
+func (d *dashboard) allowedHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	return net.ParseIP(host) != nil || host == "localhost" || host == strings.ToLower(d.host)
+}
+
+// serveEvents streams the run metadata, then the stats of each interval, as server-sent
+// events
+func (d *dashboard) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	backlog, client := d.subscribe()
+	defer d.unsubscribe(client)
+	encoded, _ := json.Marshal(metadata)
+	fmt.Fprintf(w, "event: metadata\ndata: %s\n\n", encoded)
+	for _, sample := range backlog {
+		fmt.Fprintf(w, "data: %s\n\n", sample)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case sample := <-client:
+			fmt.Fprintf(w, "data: %s\n\n", sample)
+			flusher.Flush()
+		}
+	}
+}
+
+// serveControl returns the rate and the pause of the queries, and changes them with the rate
+// and paused values of a POST request
+func serveControl(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		// Only the dashboard itself may control the run, not the other pages of the browser
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				http.Error(w, "cross-origin request", http.StatusForbidden)
+				return
+			}
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if value := r.PostForm.Get("rate"); value != "" {
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate < 0 {
+				http.Error(w, fmt.Sprintf("invalid rate %q", value), http.StatusBadRequest)
+				return
+			}
+			pacing.setRate(rate)
+		}
+		if value := r.PostForm.Get("paused"); value != "" {
+			paused, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid paused value %q", value), http.StatusBadRequest)
+				return
+			}
+			pacing.setPaused(paused)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rate, paused := pacing.state()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rate   float64 `json:"rate"`
+		Paused bool    `json:"paused"`
+	}{rate, paused})
+}
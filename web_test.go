@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDashboardEvents(t *testing.T) {
+	d := newDashboard("127.0.0.1:0")
+	d.publish(intervalSample{Length: 1, Sent: 100, Received: 99, Errors: 1})
+	server := httptest.NewServer(d.handler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("Unable to connect to the events: %s", err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Invalid content type %q", contentType)
+	}
+
+	// The metadata, the past interval, then the new one
+	reader := bufio.NewReader(response.Body)
+	var samples []intervalSample
+	for event := ""; len(samples) < 2; {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unable to read the events: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "":
+			var sample intervalSample
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &sample); err != nil {
+				t.Fatalf("Invalid sample %q: %s", line, err)
+			}
+			samples = append(samples, sample)
+			if len(samples) == 1 {
+				d.publish(intervalSample{Length: 1, Sent: 200, Paused: true})
+			}
+		case line == "":
+			event = ""
+		}
+	}
+	if samples[0].Sent != 100 || samples[0].Errors != 1 || samples[1].Sent != 200 || !samples[1].Paused {
+		t.Errorf("Invalid samples: %+v", samples)
+	}
+}
+
+func TestDashboardControl(t *testing.T) {
+	defer pacing.setRate(0)
+	defer pacing.setPaused(false)
+	server := httptest.NewServer(newDashboard("127.0.0.1:0").handler())
+	defer server.Close()
+
+	response, err := http.PostForm(server.URL+"/control", url.Values{"rate": {"500"}, "paused": {"true"}})
+	if err != nil {
+		t.Fatalf("Unable to control the run: %s", err)
+	}
+	var state struct {
+		Rate   float64 `json:"rate"`
+		Paused bool    `json:"paused"`
+	}
+	json.NewDecoder(response.Body).Decode(&state)
+	response.Body.Close()
+	if state.Rate != 500 || !state.Paused {
+		t.Errorf("Invalid state: %+v", state)
+	}
+
+	response, _ = http.PostForm(server.URL+"/control", url.Values{"rate": {"-1"}})
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Negative rates should be refused, got %s", response.Status)
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/control", strings.NewReader("paused=false"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Origin", "https://evil.example.com")
+	response, _ = http.DefaultClient.Do(request)
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("Cross-origin requests should be refused, got %s", response.Status)
+	}
+	if _, paused := pacing.state(); !paused {
+		t.Error("Refused requests should not change the state")
+	}
+}
+
+func TestDashboardHost(t *testing.T) {
+	server := httptest.NewServer(newDashboard("dashboard.example.com:8080").handler())
+	defer server.Close()
+
+	for host, allowed := range map[string]bool{
+		"":                           true,
+		"127.0.0.1:8080":             true,
+		"[::1]:8080":                 true,
+		"localhost:8080":             true,
+		"LocalHost.":                 true,
+		"dashboard.example.com:8080": true,
+		"evil.example.com:8080":      false,
+		"localhost.evil.example.com": false,
+	} {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/control", nil)
+		if host != "" {
+			request.Host = host
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Unable to get the state: %s", err)
+		}
+		response.Body.Close()
+		if refused := response.StatusCode == http.StatusForbidden; refused == allowed {
+			t.Errorf("Invalid status for the host %q: %s", host, response.Status)
+		}
+	}
+}